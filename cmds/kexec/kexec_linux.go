@@ -22,7 +22,6 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 
 	flag "github.com/spf13/pflag"
 
@@ -86,16 +85,8 @@ func (f file) Load(path, cmdLine string) error {
 }
 
 func (mb mboot) Load(path, cmdLine string) error {
-	// Trampoline should be a part of current binary.
-	p, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("Cannot find current executable path: %v", err)
-	}
-	trampoline, err := filepath.EvalSymlinks(p)
-	if err != nil {
-		return fmt.Errorf("Cannot eval symlinks for %v: %v", p, err)
-	}
-	m := multiboot.New(path, cmdLine, trampoline, mb.modules)
+	// Use the trampoline embedded into the current binary.
+	m := multiboot.New(path, cmdLine, "", mb.modules)
 	if err := m.Load(mb.debug); err != nil {
 		return fmt.Errorf("Load failed: %v", err)
 	}
@@ -0,0 +1,57 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	// kexecLoadedPath only exists if the kernel is built with CONFIG_KEXEC.
+	kexecLoadedPath = "/sys/kernel/kexec_loaded"
+	// kexecLoadDisabledPath is set to 1 to permanently disable kexec_load.
+	kexecLoadDisabledPath = "/proc/sys/kernel/kexec_load_disabled"
+	// lockdownPath reports the kernel lockdown mode, e.g.
+	// "none [integrity] confidentiality".
+	lockdownPath = "/sys/kernel/security/lockdown"
+)
+
+// KexecAvailable returns true if kexec_load(2) can be used on this system.
+//
+// It checks that the kernel was built with kexec support, that kexec_load
+// was not disabled via sysctl and that kernel lockdown does not forbid it.
+func KexecAvailable() (bool, error) {
+	if _, err := os.Stat(kexecLoadedPath); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	b, err := ioutil.ReadFile(kexecLoadDisabledPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return false, err
+	case strings.TrimSpace(string(b)) != "0":
+		return false, nil
+	}
+
+	b, err = ioutil.ReadFile(lockdownPath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return false, err
+	default:
+		// The active mode is enclosed in brackets.
+		for _, mode := range strings.Fields(string(b)) {
+			if strings.HasPrefix(mode, "[") && mode != "[none]" {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
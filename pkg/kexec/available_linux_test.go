@@ -0,0 +1,72 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKexecAvailable(t *testing.T) {
+	root, err := ioutil.TempDir("", "kexec")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	oldLoaded, oldDisabled, oldLockdown := kexecLoadedPath, kexecLoadDisabledPath, lockdownPath
+	defer func() {
+		kexecLoadedPath, kexecLoadDisabledPath, lockdownPath = oldLoaded, oldDisabled, oldLockdown
+	}()
+
+	for _, test := range []struct {
+		name     string
+		loaded   bool
+		disabled string
+		lockdown string
+		want     bool
+	}{
+		{name: "no_config_kexec", loaded: false, want: false},
+		{name: "available", loaded: true, want: true},
+		{name: "enabled", loaded: true, disabled: "0\n", lockdown: "[none] integrity confidentiality\n", want: true},
+		{name: "disabled", loaded: true, disabled: "1\n", want: false},
+		{name: "lockdown", loaded: true, disabled: "0\n", lockdown: "none [integrity] confidentiality\n", want: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(root, test.name)
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			kexecLoadedPath = filepath.Join(dir, "kexec_loaded")
+			kexecLoadDisabledPath = filepath.Join(dir, "kexec_load_disabled")
+			lockdownPath = filepath.Join(dir, "lockdown")
+
+			write := func(name, data string) {
+				if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.loaded {
+				write(kexecLoadedPath, "0\n")
+			}
+			if test.disabled != "" {
+				write(kexecLoadDisabledPath, test.disabled)
+			}
+			if test.lockdown != "" {
+				write(lockdownPath, test.lockdown)
+			}
+
+			got, err := KexecAvailable()
+			if err != nil {
+				t.Fatalf("KexecAvailable() error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("KexecAvailable() got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
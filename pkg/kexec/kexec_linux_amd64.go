@@ -17,7 +17,16 @@ import (
 //
 // The kexec_file_load(2) syscall is x86-64 bit only.
 func FileLoad(kernel, ramfs *os.File, cmdline string) error {
-	var flags int
+	return FileLoadWithFlags(kernel, ramfs, cmdline, 0)
+}
+
+// FileLoadWithFlags is like FileLoad, but passes flags, e.g.
+// unix.KEXEC_FILE_ON_CRASH, to kexec_file_load(2).
+// unix.KEXEC_FILE_NO_INITRAMFS is added if ramfs is nil.
+//
+// Unlike Load, the kernel verifies the kernel image, so it works
+// on kernels locked down to signed images.
+func FileLoadWithFlags(kernel, ramfs *os.File, cmdline string, flags int) error {
 	var ramfsfd int
 	if ramfs != nil {
 		ramfsfd = int(ramfs.Fd())
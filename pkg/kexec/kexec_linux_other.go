@@ -14,3 +14,8 @@ import (
 func FileLoad(kernel, ramfs *os.File, cmdline string) error {
 	return syscall.ENOSYS
 }
+
+// FileLoadWithFlags is not implemented on this platform and returns ENOSYS.
+func FileLoadWithFlags(kernel, ramfs *os.File, cmdline string, flags int) error {
+	return syscall.ENOSYS
+}
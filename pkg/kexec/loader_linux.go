@@ -0,0 +1,21 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kexec
+
+// Loader loads a kernel of a particular format into kexec segments.
+//
+// It lets a bootloader try several kernel formats in turn.
+type Loader interface {
+	// Probe returns an error if file is not a kernel of
+	// the loader's format. Otherwise file is the kernel
+	// loaded by the next Load.
+	Probe(file string) error
+
+	// Load loads the kernel and prepares its segments.
+	Load() error
+
+	// Segments returns the segments prepared by Load.
+	Segments() []Segment
+}
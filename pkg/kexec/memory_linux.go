@@ -5,6 +5,7 @@
 package kexec
 
 import (
+	"bufio"
 	"debug/elf"
 	"errors"
 	"fmt"
@@ -44,6 +45,22 @@ func (r Range) IsSupersetOf(r2 Range) bool {
 	return r.Start <= r2.Start && (r.Start+uintptr(r.Size)) >= (r2.Start+uintptr(r2.Size))
 }
 
+// Intersect returns the range r and r2 have in common,
+// and false if they do not overlap.
+func (r Range) Intersect(r2 Range) (Range, bool) {
+	if !r.Overlaps(r2) {
+		return Range{}, false
+	}
+	start, end := r.Start, r.Start+uintptr(r.Size)
+	if r2.Start > start {
+		start = r2.Start
+	}
+	if end2 := r2.Start + uintptr(r2.Size); end2 < end {
+		end = end2
+	}
+	return Range{Start: start, Size: uint(end - start)}, true
+}
+
 // Disjunct returns true if r and r2 do not overlap.
 func (r Range) Disjunct(r2 Range) bool {
 	return !r.Overlaps(r2)
@@ -90,6 +107,11 @@ func (s Segment) String() string {
 	return fmt.Sprintf("(virt: %#x + %#x | phys: %#x + %#x)", s.Buf.Start, s.Buf.Size, s.Phys.Start, s.Phys.Size)
 }
 
+// Bytes returns the content of the user space buffer of s.
+func (s Segment) Bytes() []byte {
+	return s.Buf.toSlice()
+}
+
 func ptrToSlice(ptr uintptr, size int) []byte {
 	var data []byte
 
@@ -195,20 +217,31 @@ func Dedup(segs []Segment) []Segment {
 // It is assumed that segments is made up of the next kernel's code and text
 // segments, and that `entry` is the entry point, either kernel entry point or trampoline.
 func Load(entry uintptr, segments []Segment, flags uint64) error {
+	segments, err := Prepare(entry, segments)
+	if err != nil {
+		return err
+	}
+	return rawLoad(entry, segments, flags)
+}
+
+// Prepare returns the segments exactly as they are passed
+// to kexec_load(2) by Load, without loading them.
+// segments is not modified.
+func Prepare(entry uintptr, segments []Segment) ([]Segment, error) {
+	segs := make([]Segment, len(segments))
 	for i := range segments {
-		segments[i] = AlignPhys(segments[i])
+		segs[i] = AlignPhys(segments[i])
 	}
 
-	segments = Dedup(segments)
+	segs = Dedup(segs)
 	ok := false
-	for _, s := range segments {
+	for _, s := range segs {
 		ok = ok || (s.Phys.Start <= entry && entry < s.Phys.Start+uintptr(s.Phys.Size))
 	}
 	if !ok {
-		return fmt.Errorf("entry point %#v is not covered by any segment", entry)
+		return nil, fmt.Errorf("entry point %#v is not covered by any segment", entry)
 	}
-
-	return rawLoad(entry, segments, flags)
+	return segs, nil
 }
 
 // ErrKexec is the error type returned kexec.
@@ -278,7 +311,8 @@ func (m *Memory) LoadElfSegments(r io.ReaderAt) error {
 var memoryMapRoot = "/sys/firmware/memmap/"
 
 // ParseMemoryMap reads firmware provided memory map
-// from /sys/firmware/memmap.
+// from /sys/firmware/memmap, or from /proc/iomem
+// if /sys/firmware/memmap is not populated.
 func (m *Memory) ParseMemoryMap() error {
 	type memRange struct {
 		// start and addresses are inclusive
@@ -335,11 +369,23 @@ func (m *Memory) ParseMemoryMap() error {
 		return nil
 	}
 
-	if err := filepath.Walk(memoryMapRoot, walker); err != nil {
+	if err := filepath.Walk(memoryMapRoot, walker); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if len(ranges) == 0 {
+		// Some platforms do not populate the sysfs memory map.
+		return m.parseIomemMap()
+	}
 
-	for _, r := range ranges {
+	// Iterate in a stable order to get the same memory map
+	// every time, even if ranges share the start address.
+	dirs := make([]string, 0, len(ranges))
+	for dir := range ranges {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		r := ranges[dir]
 		m.Phys = append(m.Phys, TypedAddressRange{
 			Range: Range{
 				Start: r.start,
@@ -348,29 +394,105 @@ func (m *Memory) ParseMemoryMap() error {
 			Type: r.typ,
 		})
 	}
-	sort.Slice(m.Phys, func(i, j int) bool {
+	sort.SliceStable(m.Phys, func(i, j int) bool {
 		return m.Phys[i].Start < m.Phys[j].Start
 	})
 	return nil
 }
 
+// DumpMap writes the memory map m.Phys to w, one range per line
+// as start address, size and type, e.g.
+//	0x100000 0x7f00000 System RAM
+// The map can be read back with LoadMap.
+func (m *Memory) DumpMap(w io.Writer) error {
+	for _, p := range m.Phys {
+		if strings.ContainsAny(string(p.Type), "\n") {
+			return fmt.Errorf("range type %q contains a newline", p.Type)
+		}
+		if _, err := fmt.Fprintf(w, "%#x %#x %s\n", p.Start, p.Size, p.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadMap reads a memory map written by DumpMap.
+// Use it to set Memory.Phys to the memory map of another machine.
+func LoadMap(r io.Reader) ([]TypedAddressRange, error) {
+	var phys []TypedAddressRange
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		f := strings.SplitN(line, " ", 3)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: malformed memory map line %q", n, line)
+		}
+		start, err := strconv.ParseUint(f[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: malformed start address: %v", n, err)
+		}
+		size, err := strconv.ParseUint(f[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: malformed size: %v", n, err)
+		}
+		phys = append(phys, TypedAddressRange{
+			Range: Range{Start: uintptr(start), Size: uint(size)},
+			Type:  RangeType(f[2]),
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return phys, nil
+}
+
 // RangeType defines type of a TypedAddressRange based on the Linux
 // kernel string provided by firmware memory map.
 type RangeType string
 
 const (
-	RangeRAM     RangeType = "System RAM"
-	RangeDefault           = "Default"
-	RangeNVACPI            = "ACPI Non-volatile Storage"
-	RangeACPI              = "ACPI Tables"
-	RangeNVS               = "Reserved"
+	RangeRAM      RangeType = "System RAM"
+	RangeDefault            = "Default"
+	RangeNVACPI             = "ACPI Non-volatile Storage"
+	RangeACPI               = "ACPI Tables"
+	RangeReserved RangeType = "Reserved"
+	RangeUnusable           = "Unusable memory"
+
+	// RangeNVS is the same as RangeReserved.
+	// ACPI NVS memory is RangeNVACPI.
+	RangeNVS = RangeReserved
 )
 
+// e820Types maps E820 memory types to the Linux kernel strings.
+var e820Types = map[uint32]RangeType{
+	1: RangeRAM,
+	2: RangeReserved,
+	3: RangeACPI,
+	4: RangeNVACPI,
+	5: RangeUnusable,
+}
+
+// RangeTypeFromE820 returns the RangeType of an E820 memory type.
+// Unknown types are mapped to RangeDefault.
+func RangeTypeFromE820(n uint32) RangeType {
+	if t, ok := e820Types[n]; ok {
+		return t
+	}
+	return RangeDefault
+}
+
 // Memory provides routines to work with physical memory ranges.
 type Memory struct {
 	Phys []TypedAddressRange
 
 	Segments []Segment
+
+	// Reserved are physical ranges, which are not used for new
+	// segments, e.g. ranges of segments to be added later.
+	Reserved []Range
 }
 
 // TypedAddressRange represents range of physical memory.
@@ -381,19 +503,56 @@ type TypedAddressRange struct {
 
 var ErrNotEnoughSpace = errors.New("not enough space")
 
+// anywhere is the whole physical memory.
+var anywhere = Range{Start: 0, Size: ^uint(0)}
+
 // FindSpace returns pointer to the physical memory,
 // where array of size sz can be stored during next
 // AddKexecSegment call.
 func (m Memory) FindSpace(sz uint) (start uintptr, err error) {
+	return m.FindSpaceAligned(sz, 1)
+}
+
+// FindSpaceAligned is like FindSpace, but returns the lowest
+// address aligned to align. align must be a power of two.
+func (m Memory) FindSpaceAligned(sz, align uint) (start uintptr, err error) {
+	if align&(align-1) != 0 {
+		return 0, fmt.Errorf("alignment %#x is not a power of two", align)
+	}
+	return m.findSpace(sz, anywhere, align)
+}
+
+// FindSpaceIn is like FindSpace, but only returns space
+// that lies completely within limit.
+func (m Memory) FindSpaceIn(sz uint, limit Range) (start uintptr, err error) {
+	return m.findSpace(sz, limit, 0)
+}
+
+// findSpace returns the lowest address within limit aligned to align,
+// where sz bytes can be stored. Addresses are always page aligned.
+func (m Memory) findSpace(sz uint, limit Range, align uint) (start uintptr, err error) {
 	sz = alignUp(sz)
-	ranges := m.availableRAM()
-	for _, r := range ranges {
+	if align == 0 {
+		align = 1
+	}
+	mask := uintptr(align - 1)
+	limitEnd := limit.Start + uintptr(limit.Size)
+	for _, r := range m.availableRAM() {
 		// don't use memory below 1M, just in case.
 		if uint(r.Start)+r.Size < 1048576 {
 			continue
 		}
-		if r.Size >= sz {
-			return r.Start, nil
+		start := r.Start
+		if start < limit.Start {
+			start = limit.Start
+		}
+		start = (alignUpPtr(start) + mask) &^ mask
+		end := r.Start + uintptr(r.Size)
+		if end > limitEnd {
+			end = limitEnd
+		}
+		if start < end && uint(end-start) >= sz {
+			return start, nil
 		}
 	}
 	return 0, ErrNotEnoughSpace
@@ -422,6 +581,260 @@ func (m *Memory) AddKexecSegment(d []byte) (addr uintptr, err error) {
 	return start, nil
 }
 
+// AddKexecSegmentIn adds d to a new kexec segment placed within limit.
+func (m *Memory) AddKexecSegmentIn(d []byte, limit Range) (addr uintptr, err error) {
+	start, err := m.FindSpaceIn(uint(len(d)), limit)
+	if err != nil {
+		return 0, err
+	}
+	m.addKexecSegment(start, d)
+	return start, nil
+}
+
+// AddKexecSegmentAligned adds d to a new kexec segment placed within limit
+// at an address aligned to align. align must be a power of two.
+func (m *Memory) AddKexecSegmentAligned(d []byte, limit Range, align uint) (addr uintptr, err error) {
+	if align&(align-1) != 0 {
+		return 0, fmt.Errorf("alignment %#x is not a power of two", align)
+	}
+	start, err := m.findSpace(uint(len(d)), limit, align)
+	if err != nil {
+		return 0, err
+	}
+	m.addKexecSegment(start, d)
+	return start, nil
+}
+
+// ReclaimableRegions returns the physical ranges, which are not RAM,
+// but can be reclaimed by the operating system once it is done
+// with their content, e.g. ACPI tables.
+//
+// They are never used for kexec segments.
+func (m Memory) ReclaimableRegions() []Range {
+	var rs []Range
+	for _, r := range m.Phys {
+		if r.Type == RangeACPI {
+			rs = append(rs, r.Range)
+		}
+	}
+	return rs
+}
+
+// Validate returns an error if the physical ranges of two segments
+// overlap, in which case one of them would be corrupted by kexec.
+func (m Memory) Validate() error {
+	for i, s := range m.Segments {
+		for _, s2 := range m.Segments[:i] {
+			// Empty segments occupy no memory.
+			if s.Phys.Size == 0 || s2.Phys.Size == 0 {
+				continue
+			}
+			if s.Phys.Overlaps(s2.Phys) {
+				return fmt.Errorf("segment [%#x, %#x) overlaps segment [%#x, %#x)",
+					s.Phys.Start, s.Phys.Start+uintptr(s.Phys.Size), s2.Phys.Start, s2.Phys.Start+uintptr(s2.Phys.Size))
+			}
+		}
+	}
+	return nil
+}
+
+// LimitTo reserves all physical memory outside of r,
+// so that new segments are only placed within r.
+func (m *Memory) LimitTo(r Range) {
+	if r.Start > 0 {
+		m.Reserved = append(m.Reserved, Range{Start: 0, Size: uint(r.Start)})
+	}
+	if end := r.Start + uintptr(r.Size); end != 0 {
+		m.Reserved = append(m.Reserved, Range{Start: end, Size: ^uint(0) - uint(end)})
+	}
+}
+
+var (
+	crashSizePath = "/sys/kernel/kexec_crash_size"
+	iomemPath     = "/proc/iomem"
+)
+
+// ErrNoCrashRegion is returned by CrashRegion if no
+// memory is reserved for the crash kernel.
+var ErrNoCrashRegion = errors.New("no memory reserved for the crash kernel")
+
+// CrashRegion returns the physical memory reserved for the crash kernel
+// with the crashkernel= command line parameter, as found in /proc/iomem.
+func CrashRegion() (Range, error) {
+	b, err := ioutil.ReadFile(crashSizePath)
+	if err != nil {
+		return Range{}, err
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(string(b)), 0, 64)
+	if err != nil {
+		return Range{}, fmt.Errorf("error parsing %v: %v", crashSizePath, err)
+	}
+	if size == 0 {
+		return Range{}, ErrNoCrashRegion
+	}
+
+	entries, err := readIomem()
+	if err != nil {
+		return Range{}, err
+	}
+	for _, e := range entries {
+		if e.name != "Crash kernel" {
+			continue
+		}
+		// The region may have been shrunk with kexec_crash_size.
+		if e.end-e.start+1 < size {
+			size = e.end - e.start + 1
+		}
+		return Range{Start: uintptr(e.start), Size: uint(size)}, nil
+	}
+	return Range{}, ErrNoCrashRegion
+}
+
+// iomemEntry is a resource listed in /proc/iomem.
+type iomemEntry struct {
+	// start and end addresses are inclusive.
+	start, end uint64
+	name       string
+	// nested is true for resources within another resource.
+	nested bool
+}
+
+// readIomem parses the resources listed in /proc/iomem.
+func readIomem() ([]iomemEntry, error) {
+	b, err := ioutil.ReadFile(iomemPath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []iomemEntry
+	// Lines look like "  2a000000-31ffffff : Crash kernel",
+	// where the end address is inclusive. Nested resources
+	// are indented.
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		f := strings.SplitN(line, " : ", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("malformed %v line %q", iomemPath, line)
+		}
+		se := strings.SplitN(strings.TrimSpace(f[0]), "-", 2)
+		if len(se) != 2 {
+			return nil, fmt.Errorf("malformed %v line %q", iomemPath, line)
+		}
+		start, err := strconv.ParseUint(se[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %v line %q: %v", iomemPath, line, err)
+		}
+		end, err := strconv.ParseUint(se[1], 16, 64)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("malformed %v line %q", iomemPath, line)
+		}
+		entries = append(entries, iomemEntry{
+			start:  start,
+			end:    end,
+			name:   strings.TrimSpace(f[1]),
+			nested: strings.HasPrefix(line, " "),
+		})
+	}
+	return entries, nil
+}
+
+// iomemTypes maps the names of top level /proc/iomem
+// resources to the memory map types.
+var iomemTypes = map[string]RangeType{
+	"System RAM":                RangeRAM,
+	"ACPI Tables":               RangeACPI,
+	"ACPI Non-volatile Storage": RangeNVACPI,
+	"Reserved":                  RangeReserved,
+	"reserved":                  RangeReserved,
+}
+
+// parseIomemMap reads the memory map from /proc/iomem.
+// Only top level resources of the types in iomemTypes are used,
+// other resources such as PCI windows are not part of the memory map.
+func (m *Memory) parseIomemMap() error {
+	entries, err := readIomem()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		typ, ok := iomemTypes[e.name]
+		if e.nested || !ok {
+			continue
+		}
+		if e.start == 0 && e.end == 0 {
+			// Unprivileged readers see all addresses as zero.
+			return fmt.Errorf("%v does not show addresses, CAP_SYS_ADMIN is required", iomemPath)
+		}
+		// Like the sysfs memory map, Size is end - start
+		// for the inclusive end address.
+		m.Phys = append(m.Phys, TypedAddressRange{
+			Range: Range{Start: uintptr(e.start), Size: uint(e.end - e.start)},
+			Type:  typ,
+		})
+	}
+	sort.SliceStable(m.Phys, func(i, j int) bool {
+		return m.Phys[i].Start < m.Phys[j].Start
+	})
+	return nil
+}
+
+// UseCrashRegion limits the placement of new segments
+// to the memory reserved for the crash kernel.
+func (m *Memory) UseCrashRegion() error {
+	r, err := CrashRegion()
+	if err != nil {
+		return err
+	}
+	m.LimitTo(r)
+	return nil
+}
+
+// Available returns the page aligned physical RAM ranges,
+// which are not used by segments or reserved, sorted by address.
+func (m Memory) Available() []Range {
+	var rs []Range
+	for _, r := range m.availableRAM() {
+		rs = append(rs, r.Range)
+	}
+	return rs
+}
+
+// busy returns the sorted and merged physical ranges
+// of kexec segments and reserved ranges.
+func (m Memory) busy() []Range {
+	var rs []Range
+	for _, s := range m.Segments {
+		if s.Phys.Size > 0 {
+			rs = append(rs, s.Phys)
+		}
+	}
+	for _, r := range m.Reserved {
+		if r.Size > 0 {
+			rs = append(rs, r)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Start < rs[j].Start
+	})
+
+	var ret []Range
+	for _, r := range rs {
+		if n := len(ret); n > 0 {
+			last := &ret[n-1]
+			lastEnd := last.Start + uintptr(last.Size)
+			if r.Start <= lastEnd {
+				if end := r.Start + uintptr(r.Size); end > lastEnd {
+					last.Size = uint(end - last.Start)
+				}
+				continue
+			}
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
 // availableRAM subtracts physical ranges of kexec segments from
 // RAM segments of TypedAddressRange aligning range beginnings
 // to a page boundary.
@@ -456,8 +869,8 @@ func (m Memory) availableRAM() (avail []TypedAddressRange) {
 			addPoint(s.Range, true)
 		}
 	}
-	for _, s := range m.Segments {
-		addPoint(s.Phys, false)
+	for _, r := range m.busy() {
+		addPoint(r, false)
 	}
 
 	sort.Slice(points, func(i, j int) bool {
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -68,6 +69,59 @@ func TestParseMemoryMap(t *testing.T) {
 	}
 }
 
+func TestParseMemoryMapIomem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iomem")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRoot, oldIomem := memoryMapRoot, iomemPath
+	defer func() { memoryMapRoot, iomemPath = oldRoot, oldIomem }()
+	memoryMapRoot, iomemPath = path.Join(dir, "memmap"), path.Join(dir, "iomem")
+
+	const iomem = `00000000-00000fff : Reserved
+00001000-0009fbff : System RAM
+000a0000-000bffff : PCI Bus 0000:00
+000f0000-000fffff : reserved
+  000f0000-000fffff : System ROM
+00100000-07fdffff : System RAM
+  01000000-01e00ea0 : Kernel code
+07fe0000-07feffff : ACPI Tables
+07ff0000-07ffffff : ACPI Non-volatile Storage
+fec00000-fec003ff : IOAPIC 0
+`
+	if err := ioutil.WriteFile(iomemPath, []byte(iomem), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []TypedAddressRange{
+		{Range: Range{Start: 0, Size: 0xfff}, Type: RangeReserved},
+		{Range: Range{Start: 0x1000, Size: 0x9ebff}, Type: RangeRAM},
+		{Range: Range{Start: 0xf0000, Size: 0xffff}, Type: RangeReserved},
+		{Range: Range{Start: 0x100000, Size: 0x7edffff}, Type: RangeRAM},
+		{Range: Range{Start: 0x7fe0000, Size: 0xffff}, Type: RangeACPI},
+		{Range: Range{Start: 0x7ff0000, Size: 0xffff}, Type: RangeNVACPI},
+	}
+
+	var mem Memory
+	if err := mem.ParseMemoryMap(); err != nil {
+		t.Fatalf("ParseMemoryMap() error: %v", err)
+	}
+	if !reflect.DeepEqual(mem.Phys, want) {
+		t.Errorf("ParseMemoryMap() got %v, want %v", mem.Phys, want)
+	}
+
+	// Without privileges all addresses are zero.
+	if err := ioutil.WriteFile(iomemPath, []byte("00000000-00000000 : System RAM\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mem = Memory{}
+	if err := mem.ParseMemoryMap(); err == nil {
+		t.Errorf("ParseMemoryMap() with hidden addresses got nil error, want error")
+	}
+}
+
 func TestAvailableRAM(t *testing.T) {
 	old := pageMask
 	defer func() {
@@ -107,6 +161,38 @@ func TestAvailableRAM(t *testing.T) {
 	}
 }
 
+func TestAvailableRAMReserved(t *testing.T) {
+	old := pageMask
+	defer func() {
+		pageMask = old
+	}()
+	pageMask = 4095
+
+	mem := Memory{
+		Phys: []TypedAddressRange{
+			{Range: Range{Start: 0, Size: 32768}, Type: RangeRAM},
+		},
+		// The reserved range overlaps the segment, as a segment
+		// added after reserving its range does.
+		Segments: []Segment{
+			{Phys: Range{Start: 8192, Size: 4096}},
+		},
+		Reserved: []Range{
+			{Start: 8192, Size: 8192},
+			{Start: 24576, Size: 4096},
+		},
+	}
+
+	want := []TypedAddressRange{
+		{Range: Range{Start: 0, Size: 8192}, Type: RangeRAM},
+		{Range: Range{Start: 16384, Size: 8192}, Type: RangeRAM},
+		{Range: Range{Start: 28672, Size: 4096}, Type: RangeRAM},
+	}
+	if got := mem.availableRAM(); !reflect.DeepEqual(got, want) {
+		t.Errorf("availableRAM() got %+v, want %+v", got, want)
+	}
+}
+
 func TestAlignPhys(t *testing.T) {
 	for _, test := range []struct {
 		name      string
@@ -258,3 +344,286 @@ func TestDedup(t *testing.T) {
 	}
 
 }
+
+func TestRangeTypeFromE820(t *testing.T) {
+	for _, test := range []struct {
+		n    uint32
+		want RangeType
+	}{
+		{n: 1, want: RangeRAM},
+		{n: 2, want: RangeNVS},
+		{n: 3, want: RangeACPI},
+		{n: 4, want: RangeNVACPI},
+		{n: 5, want: RangeUnusable},
+		{n: 0xf0, want: RangeDefault},
+	} {
+		if got := RangeTypeFromE820(test.n); got != test.want {
+			t.Errorf("RangeTypeFromE820(%d) got %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestFindSpaceAligned(t *testing.T) {
+	old := pageMask
+	defer func() {
+		pageMask = old
+	}()
+	pageMask = 4095
+
+	mem := Memory{
+		Phys: []TypedAddressRange{
+			{Range: Range{Start: 0x100000, Size: 0x400000}, Type: RangeRAM},
+		},
+		Segments: []Segment{
+			{Phys: Range{Start: 0x100000, Size: 0x1000}},
+		},
+	}
+
+	for _, test := range []struct {
+		sz, align uint
+		want      uintptr
+		wantErr   bool
+	}{
+		{sz: 0x1000, align: 1, want: 0x101000},
+		{sz: 0x1000, align: 0x100000, want: 0x200000},
+		{sz: 0x300000, align: 0x200000, want: 0x200000},
+		{sz: 0x300001, align: 0x200000, wantErr: true},
+		{sz: 0x1000, align: 3, wantErr: true},
+	} {
+		got, err := mem.FindSpaceAligned(test.sz, test.align)
+		if (err != nil) != test.wantErr {
+			t.Errorf("FindSpaceAligned(%#x, %#x) got error %v, want error %v", test.sz, test.align, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("FindSpaceAligned(%#x, %#x) got %#x, want %#x", test.sz, test.align, got, test.want)
+		}
+	}
+
+	got, err := mem.FindSpace(0x1000)
+	if err != nil {
+		t.Fatalf("FindSpace() error: %v", err)
+	}
+	if got != 0x101000 {
+		t.Errorf("FindSpace() got %#x, want %#x", got, 0x101000)
+	}
+}
+
+func TestReclaimableRegions(t *testing.T) {
+	mem := Memory{
+		Phys: []TypedAddressRange{
+			{Range: Range{Start: 0, Size: 0x9fc00}, Type: RangeRAM},
+			{Range: Range{Start: 0x100000, Size: 0x7ee0000}, Type: RangeRAM},
+			{Range: Range{Start: 0x7fe0000, Size: 0x10000}, Type: RangeACPI},
+			{Range: Range{Start: 0x7ff0000, Size: 0x10000}, Type: RangeNVACPI},
+			{Range: Range{Start: 0xfed00000, Size: 0x1000}, Type: RangeACPI},
+			{Range: Range{Start: 0xfffc0000, Size: 0x40000}, Type: RangeNVS},
+		},
+	}
+	want := []Range{
+		{Start: 0x7fe0000, Size: 0x10000},
+		{Start: 0xfed00000, Size: 0x1000},
+	}
+	if got := mem.ReclaimableRegions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReclaimableRegions() got %+v, want %+v", got, want)
+	}
+}
+
+func TestUseCrashRegion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldSize, oldIomem := crashSizePath, iomemPath
+	defer func() { crashSizePath, iomemPath = oldSize, oldIomem }()
+	crashSizePath, iomemPath = path.Join(dir, "kexec_crash_size"), path.Join(dir, "iomem")
+
+	const iomem = `00000000-00000fff : Reserved
+00001000-0009fbff : System RAM
+00100000-07ffffff : System RAM
+  01000000-01e00ea0 : Kernel code
+  04000000-04ffffff : Crash kernel
+fec00000-fec003ff : IOAPIC 0
+`
+	if err := ioutil.WriteFile(iomemPath, []byte(iomem), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		size    string
+		want    Range
+		wantErr error
+	}{
+		{name: "reserved", size: "16777216\n", want: Range{Start: 0x4000000, Size: 0x1000000}},
+		{name: "shrunk", size: "4194304\n", want: Range{Start: 0x4000000, Size: 0x400000}},
+		{name: "none", size: "0\n", wantErr: ErrNoCrashRegion},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(crashSizePath, []byte(test.size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := CrashRegion()
+			if err != test.wantErr {
+				t.Fatalf("CrashRegion() got error %v, want %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("CrashRegion() got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	if err := ioutil.WriteFile(crashSizePath, []byte("16777216\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mem := Memory{
+		Phys: []TypedAddressRange{
+			{Range: Range{Start: 0x100000, Size: 0x7f00000}, Type: RangeRAM},
+		},
+	}
+	if err := mem.UseCrashRegion(); err != nil {
+		t.Fatalf("UseCrashRegion() error: %v", err)
+	}
+	region := Range{Start: 0x4000000, Size: 0x1000000}
+	for i := 0; i < 4; i++ {
+		addr, err := mem.AddKexecSegment(make([]byte, 0x100000))
+		if err != nil {
+			t.Fatalf("AddKexecSegment() error: %v", err)
+		}
+		if r := (Range{Start: addr, Size: 0x100000}); !region.IsSupersetOf(r) {
+			t.Errorf("segment %+v is outside of the crash region %+v", r, region)
+		}
+	}
+	if _, err := mem.AddKexecSegment(make([]byte, 0x1000000)); err != ErrNotEnoughSpace {
+		t.Errorf("AddKexecSegment() larger than the free crash region got error %v, want %v", err, ErrNotEnoughSpace)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		segs    []Segment
+		wantErr string
+	}{
+		{
+			name: "adjacent",
+			segs: []Segment{
+				{Phys: Range{Start: 0x1000, Size: 0x1000}},
+				{Phys: Range{Start: 0x3000, Size: 0x1000}},
+				{Phys: Range{Start: 0x2000, Size: 0x1000}},
+			},
+		},
+		{
+			name: "empty",
+			segs: []Segment{
+				{Phys: Range{Start: 0x1000, Size: 0x1000}},
+				{Phys: Range{Start: 0x1800, Size: 0}},
+			},
+		},
+		{
+			name: "overlap",
+			segs: []Segment{
+				{Phys: Range{Start: 0x1000, Size: 0x1000}},
+				{Phys: Range{Start: 0x3000, Size: 0x1000}},
+				{Phys: Range{Start: 0x1800, Size: 0x1000}},
+			},
+			wantErr: "segment [0x1800, 0x2800) overlaps segment [0x1000, 0x2000)",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := Memory{Segments: test.segs}.Validate()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("Validate() got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	for _, test := range []struct {
+		r, r2 Range
+		want  Range
+		ok    bool
+	}{
+		{r: Range{Start: 0x1000, Size: 0x2000}, r2: Range{Start: 0x2000, Size: 0x2000}, want: Range{Start: 0x2000, Size: 0x1000}, ok: true},
+		{r: Range{Start: 0x1000, Size: 0x4000}, r2: Range{Start: 0x2000, Size: 0x1000}, want: Range{Start: 0x2000, Size: 0x1000}, ok: true},
+		{r: Range{Start: 0x2000, Size: 0x1000}, r2: Range{Start: 0x1000, Size: 0x4000}, want: Range{Start: 0x2000, Size: 0x1000}, ok: true},
+		{r: Range{Start: 0x1000, Size: 0x1000}, r2: Range{Start: 0x2000, Size: 0x1000}},
+	} {
+		got, ok := test.r.Intersect(test.r2)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%+v.Intersect(%+v) got %+v, %t, want %+v, %t", test.r, test.r2, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	old := pageMask
+	defer func() {
+		pageMask = old
+	}()
+	pageMask = 4095
+
+	mem := Memory{
+		Phys: []TypedAddressRange{
+			{Range: Range{Start: 0, Size: 0x8000}, Type: RangeRAM},
+			{Range: Range{Start: 0x8000, Size: 0x1000}, Type: RangeACPI},
+		},
+		Segments: []Segment{
+			{Phys: Range{Start: 0x2000, Size: 0x1000}},
+		},
+		Reserved: []Range{
+			{Start: 0x6000, Size: 0x2000},
+		},
+	}
+	want := []Range{
+		{Start: 0, Size: 0x2000},
+		{Start: 0x3000, Size: 0x3000},
+	}
+	if got := mem.Available(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Available() got %+v, want %+v", got, want)
+	}
+}
+
+func TestDumpLoadMap(t *testing.T) {
+	m := Memory{
+		Phys: []TypedAddressRange{
+			{Range: Range{Start: 0, Size: 0x9fc00}, Type: RangeRAM},
+			{Range: Range{Start: 0x9fc00, Size: 0x400}, Type: RangeReserved},
+			{Range: Range{Start: 0xf0000, Size: 0}, Type: RangeDefault},
+			{Range: Range{Start: 0x100000, Size: 0x7f00000}, Type: RangeRAM},
+			{Range: Range{Start: 0x8000000, Size: 0x1000}, Type: RangeACPI},
+			{Range: Range{Start: 0x8001000, Size: 0x1000}, Type: RangeNVACPI},
+			{Range: Range{Start: 0xfffff000, Size: 0x1000}, Type: RangeUnusable},
+		},
+	}
+	buf := bytes.Buffer{}
+	if err := m.DumpMap(&buf); err != nil {
+		t.Fatalf("DumpMap() error: %v", err)
+	}
+	got, err := LoadMap(&buf)
+	if err != nil {
+		t.Fatalf("LoadMap() error: %v", err)
+	}
+	if !reflect.DeepEqual(got, m.Phys) {
+		t.Errorf("LoadMap(DumpMap()) got %v, want %v", got, m.Phys)
+	}
+
+	for _, s := range []string{
+		"0x1000 0x1000\n",
+		"start 0x1000 System RAM\n",
+		"0x1000 size System RAM\n",
+	} {
+		if _, err := LoadMap(strings.NewReader(s)); err == nil {
+			t.Errorf("LoadMap(%q) got nil error, want error", s)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// loadAout loads a kernel using the address fields of the multiboot
+// header, found at offset hdrOff of the kernel image b, as defined in
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Address-field-of-Multiboot-header.
+func (m *Multiboot) loadAout(b []byte, hdrOff int) error {
+	h := m.header
+	if h.HeaderAddr < h.LoadAddr {
+		return fmt.Errorf("header address %#x is below load address %#x", h.HeaderAddr, h.LoadAddr)
+	}
+	// The offset in the image of the first byte to be loaded.
+	start := int64(hdrOff) - int64(h.HeaderAddr-h.LoadAddr)
+	if start < 0 {
+		return fmt.Errorf("load address %#x is before the beginning of the image", h.LoadAddr)
+	}
+
+	// Zero load end address means the whole image is loaded.
+	end := int64(len(b))
+	if h.LoadEndAddr != 0 {
+		if h.LoadEndAddr < h.LoadAddr {
+			return fmt.Errorf("load end address %#x is below load address %#x", h.LoadEndAddr, h.LoadAddr)
+		}
+		end = start + int64(h.LoadEndAddr-h.LoadAddr)
+	}
+	if end > int64(len(b)) {
+		return fmt.Errorf("load end address %#x is beyond the end of the image", h.LoadEndAddr)
+	}
+	if start >= end {
+		return fmt.Errorf("nothing to load between %#x and %#x", h.LoadAddr, h.LoadEndAddr)
+	}
+
+	// Zero BSS end address means there is no BSS segment.
+	size := uint(end - start)
+	if h.BSSEndAddr != 0 {
+		if h.BSSEndAddr < h.LoadAddr+uint32(size) {
+			return fmt.Errorf("BSS end address %#x is below load end address %#x", h.BSSEndAddr, h.LoadAddr+uint32(size))
+		}
+		size = uint(h.BSSEndAddr - h.LoadAddr)
+	}
+
+	// kexec zero-fills the part of the segment
+	// not covered by the buffer, i.e. the BSS.
+	d := make([]byte, end-start)
+	copy(d, b[start:end])
+	m.mem.Segments = append(m.mem.Segments, kexec.NewSegment(d, kexec.Range{
+		Start: uintptr(h.LoadAddr),
+		Size:  size,
+	}))
+	m.kernelEntry = uintptr(h.EntryAddr)
+	m.aout = true
+	return nil
+}
+
+// addAoutSymbols copies the a.out symbol and string tables to a kexec
+// segment and returns the a.out symbol table symbols of the multiboot info.
+//
+// The segment layout is defined in
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Boot-information-format:
+// the size of the symbol table followed by the table, then the size
+// of the string table, which includes the size field itself,
+// followed by the strings.
+func (m *Multiboot) addAoutSymbols() ([4]uint32, error) {
+	tabsize := uint32(len(m.aoutSymtab))
+	strsize := uint32(len(m.aoutStrtab)) + 4
+
+	buf := bytes.Buffer{}
+	for _, v := range []interface{}{tabsize, m.aoutSymtab, strsize, m.aoutStrtab} {
+		if err := binary.Write(&buf, m.byteOrder, v); err != nil {
+			return [4]uint32{}, err
+		}
+	}
+	addr, err := m.mem.AddKexecSegmentIn(buf.Bytes(), below4G)
+	if err != nil {
+		return [4]uint32{}, err
+	}
+	syms, err := addr32("a.out symbols", addr, uint(buf.Len()))
+	if err != nil {
+		return [4]uint32{}, err
+	}
+	return [4]uint32{tabsize, strsize, syms, 0}, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// createAoutKernel returns a non-ELF kernel image loaded with the a.out kludge.
+// The multiboot header is placed at offset 16 and the image is loaded at kernelBase.
+func createAoutKernel(t *testing.T, size int) []byte {
+	const off = 16
+	flags := Flag(flagHeaderAoutKludge)
+	hdr := Header{
+		mandatory: mandatory{
+			Magic:    headerMagic,
+			Flags:    flags,
+			Checksum: -(headerMagic + uint32(flags)),
+		},
+		optional: optional{
+			HeaderAddr:  kernelBase + off,
+			LoadAddr:    kernelBase,
+			LoadEndAddr: kernelBase + uint32(size),
+			BSSEndAddr:  kernelBase + 0x10000,
+			EntryAddr:   kernelBase + 0x100,
+		},
+	}
+	w := bytes.Buffer{}
+	if err := binary.Write(&w, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Repeat([]byte{0x90}, size)
+	copy(b[off:], w.Bytes())
+	return b
+}
+
+func TestLoadAout(t *testing.T) {
+	trampoline := testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel := createAoutKernel(t, 0x1000)
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Probe(name); err != nil {
+		t.Fatalf("Probe() error: %v", err)
+	}
+
+	m := New(name, "", trampoline, nil, WithMemoryMap(testMemory))
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if m.kernelEntry != kernelBase+0x100 {
+		t.Errorf("kernelEntry got %#x, want %#x", m.kernelEntry, kernelBase+0x100)
+	}
+
+	want := kexec.Range{Start: kernelBase, Size: 0x10000}
+	for _, s := range m.Segments() {
+		if s.Phys.Start != want.Start {
+			continue
+		}
+		if s.Phys != want {
+			t.Errorf("kernel segment got %+v, want %+v", s.Phys, want)
+		}
+		if !bytes.Equal(s.Bytes(), kernel) {
+			t.Errorf("kernel segment content differs from the image")
+		}
+		return
+	}
+	t.Errorf("no kernel segment at %#x", want.Start)
+}
+
+func TestWithoutKernelDecompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The kernel is a valid gzip stream, which stores the multiboot
+	// header in the extra field of the gzip header at offset 12.
+	const off = 12
+	flags := Flag(flagHeaderAoutKludge)
+	hdr := Header{
+		mandatory: mandatory{
+			Magic:    headerMagic,
+			Flags:    flags,
+			Checksum: -(headerMagic + uint32(flags)),
+		},
+		optional: optional{
+			HeaderAddr: kernelBase + off,
+			LoadAddr:   kernelBase,
+			EntryAddr:  kernelBase,
+		},
+	}
+	w := bytes.Buffer{}
+	if err := binary.Write(&w, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	kernel := bytes.Buffer{}
+	z := gzip.NewWriter(&kernel)
+	z.Extra = w.Bytes()
+	if _, err := z.Write([]byte("not a kernel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "decompressed", wantErr: true},
+		{name: "raw", opts: []Option{WithoutKernelDecompression()}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := New(name, "", "", nil, test.opts...)
+			b, err := m.readKernel()
+			if err != nil {
+				t.Fatalf("readKernel() error: %v", err)
+			}
+			var off int
+			m.header, off, err = findHeader(bytes.NewReader(b))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("findHeader() got error %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if off != 12 {
+				t.Errorf("findHeader() got offset %d, want 12", off)
+			}
+			if err := m.loadAout(b, off); err != nil {
+				t.Errorf("loadAout() error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAoutSymbols(t *testing.T) {
+	symtab := bytes.Repeat([]byte{0xAA}, 24)
+	strtab := []byte("start\x00main\x00")
+
+	b := createAoutKernel(t, 0x1000)
+	m := New("", "", "", nil, WithAoutSymbols(symtab, strtab), WithMemoryMap(testMemory))
+	var off int
+	var err error
+	if m.header, off, err = findHeader(bytes.NewReader(b)); err != nil {
+		t.Fatalf("findHeader() error: %v", err)
+	}
+	if err := m.loadAout(b, off); err != nil {
+		t.Fatalf("loadAout() error: %v", err)
+	}
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	if m.info.Flags&flagInfoAoutSyms == 0 {
+		t.Errorf("Flags got %#x, want a.out symbols flag set", m.info.Flags)
+	}
+	if m.info.Flags&flagInfoElfSHDR != 0 {
+		t.Errorf("Flags got %#x, want ELF section header flag cleared", m.info.Flags)
+	}
+	tabsize, strsize, addr := m.info.Syms[0], m.info.Syms[1], m.info.Syms[2]
+	if tabsize != uint32(len(symtab)) || strsize != uint32(len(strtab))+4 {
+		t.Errorf("Syms got tabsize %d, strsize %d, want %d, %d", tabsize, strsize, len(symtab), len(strtab)+4)
+	}
+
+	want := bytes.Buffer{}
+	for _, v := range []interface{}{tabsize, symtab, strsize, strtab} {
+		if err := binary.Write(&want, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(addr), want.Len()); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("a.out symbols got % x, want % x", got, want.Bytes())
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// APMTable is the APM BIOS interface table passed to the kernel,
+// as defined in
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#APM-table.
+type APMTable struct {
+	Version uint16
+	// CSeg is the protected mode 32-bit code segment.
+	CSeg uint16
+	// Offset is the offset of the entry point.
+	Offset uint32
+	// CSeg16 is the protected mode 16-bit code segment.
+	CSeg16 uint16
+	// DSeg is the protected mode 16-bit data segment.
+	DSeg  uint16
+	Flags uint16
+	// CSegLen, CSeg16Len and DSegLen are the lengths of the segments.
+	CSegLen   uint16
+	CSeg16Len uint16
+	DSegLen   uint16
+}
+
+var sizeofAPMTable = uint(binary.Size(APMTable{}))
+
+func (m *Multiboot) addAPMTable() (uintptr, error) {
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, m.byteOrder, m.apmTable); err != nil {
+		return 0, err
+	}
+	return m.mem.AddKexecSegmentIn(buf.Bytes(), below4G)
+}
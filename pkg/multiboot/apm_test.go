@@ -0,0 +1,47 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWithAPMTable(t *testing.T) {
+	m := New("", "", "", nil)
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoAPMTable != 0 || m.info.APMTable != 0 {
+		t.Errorf("Flags got %#x, APMTable %#x, want APM table flag cleared", m.info.Flags, m.info.APMTable)
+	}
+
+	m = New("", "", "", nil, WithAPMTable(APMTable{
+		Version:   0x0102,
+		CSeg:      0xf000,
+		Offset:    0x12345678,
+		CSeg16:    0xf001,
+		DSeg:      0x0040,
+		Flags:     0x0003,
+		CSegLen:   0xfff0,
+		CSeg16Len: 0xfff1,
+		DSegLen:   0x0100,
+	}))
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoAPMTable == 0 {
+		t.Fatalf("Flags got %#x, want APM table flag set", m.info.Flags)
+	}
+	want := []byte{
+		0x02, 0x01, 0x00, 0xf0, 0x78, 0x56, 0x34, 0x12, 0x01, 0xf0,
+		0x40, 0x00, 0x03, 0x00, 0xf0, 0xff, 0xf1, 0xff, 0x00, 0x01,
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(m.info.APMTable), len(want)); !bytes.Equal(got, want) {
+		t.Errorf("APM table got %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var sysfsBlock = "/sys/block"
+
+// firstBIOSDrive is the BIOS drive number of the first hard disk.
+const firstBIOSDrive = 0x80
+
+// unusedPart marks an unused partition in the boot device.
+const unusedPart = 0xFF
+
+// packBootDevice packs drive and partition numbers as defined in
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Boot-information-format.
+func packBootDevice(drive, part1, part2, part3 uint8) uint32 {
+	return uint32(drive)<<24 | uint32(part1)<<16 | uint32(part2)<<8 | uint32(part3)
+}
+
+// diskSchemes are the name prefixes of the disk naming schemes.
+// Longer prefixes come first, so that e.g. xvda is not taken for vda.
+var diskSchemes = []string{"mmcblk", "nvme", "xvd", "hd", "sd", "vd"}
+
+// diskScheme returns the naming scheme of a disk in /sys/block.
+// Names of unknown schemes without their trailing digits are
+// considered a scheme of their own.
+func diskScheme(name string) string {
+	for _, scheme := range diskSchemes {
+		if strings.HasPrefix(name, scheme) {
+			return scheme
+		}
+	}
+	return strings.TrimRight(name, "0123456789")
+}
+
+// BootDeviceFromPath returns the packed boot device value
+// for a block device path, e.g. /dev/sda1.
+//
+// BIOS drive numbers are guessed from the order of disks in /sys/block,
+// which might not match the order used by the firmware. The mapping is
+// ambiguous and an error is returned if the disks use different naming
+// schemes, e.g. sda and nvme0n1, as they are attached to different
+// drivers, whose order in the firmware is unknown.
+func BootDeviceFromPath(path string) (uint32, error) {
+	name := filepath.Base(path)
+
+	fis, err := ioutil.ReadDir(sysfsBlock)
+	if err != nil {
+		return 0, err
+	}
+	// Only consider disks backed by a device, i.e. skip loop and ram disks.
+	var disks []string
+	for _, fi := range fis {
+		if _, err := os.Stat(filepath.Join(sysfsBlock, fi.Name(), "device")); err == nil {
+			disks = append(disks, fi.Name())
+		}
+	}
+	sort.Strings(disks)
+	for i := 1; i < len(disks); i++ {
+		if diskScheme(disks[i]) != diskScheme(disks[0]) {
+			return 0, fmt.Errorf("cannot map %v to a BIOS drive: the order of disks %v with different naming schemes is ambiguous", path, disks)
+		}
+	}
+
+	for i, disk := range disks {
+		if i > 0xFF-firstBIOSDrive {
+			break
+		}
+		drive := uint8(firstBIOSDrive + i)
+		if disk == name {
+			return packBootDevice(drive, unusedPart, unusedPart, unusedPart), nil
+		}
+		if !strings.HasPrefix(name, disk) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(sysfsBlock, disk, name, "partition"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		part, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse partition number of %v: %v", path, err)
+		}
+		if part < 1 || part > unusedPart {
+			return 0, fmt.Errorf("partition number %d of %v is out of range", part, path)
+		}
+		// Partition numbers start from zero, DOS extended
+		// partitions are numbered starting from 4.
+		return packBootDevice(drive, uint8(part-1), unusedPart, unusedPart), nil
+	}
+	return 0, fmt.Errorf("cannot map %v to a BIOS drive", path)
+}
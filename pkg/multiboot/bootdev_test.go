@@ -0,0 +1,122 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBootDeviceFromPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	old := sysfsBlock
+	sysfsBlock = root
+	defer func() { sysfsBlock = old }()
+
+	for _, dir := range []string{"loop0", "sda/device", "sda/sda1", "sda/sda5", "sdb/device"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for part, num := range map[string]string{"sda/sda1": "1\n", "sda/sda5": "5\n"} {
+		if err := ioutil.WriteFile(filepath.Join(root, part, "partition"), []byte(num), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		path    string
+		want    uint32
+		wantErr bool
+	}{
+		{path: "/dev/sda1", want: 0x8000FFFF},
+		{path: "/dev/sda5", want: 0x8004FFFF},
+		{path: "/dev/sdb", want: 0x81FFFFFF},
+		{path: "/dev/sda2", wantErr: true},
+		{path: "/dev/loop0", wantErr: true},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := BootDeviceFromPath(test.path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("BootDeviceFromPath(%q) got error %v, want error %v", test.path, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("BootDeviceFromPath(%q) got %#x, want %#x", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBootDeviceFromPathAmbiguous(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	old := sysfsBlock
+	sysfsBlock = root
+	defer func() { sysfsBlock = old }()
+
+	for _, dir := range []string{"nvme0n1/device", "sda/device", "sda/sda1"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sda/sda1/partition"), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The firmware order of NVMe and SATA disks is unknown.
+	if got, err := BootDeviceFromPath("/dev/sda1"); err == nil {
+		t.Errorf("BootDeviceFromPath(%q) got %#x, want error for mixed naming schemes", "/dev/sda1", got)
+	}
+}
+
+func TestDiskScheme(t *testing.T) {
+	for name, want := range map[string]string{
+		"sda":     "sd",
+		"sdaa":    "sd",
+		"nvme0n1": "nvme",
+		"xvda":    "xvd",
+		"vdb":     "vd",
+		"mmcblk0": "mmcblk",
+		"pmem12":  "pmem",
+	} {
+		if got := diskScheme(name); got != want {
+			t.Errorf("diskScheme(%q) got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestWithBootDevice(t *testing.T) {
+	m := New("", "", "", nil)
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoBootDev != 0 {
+		t.Errorf("Flags got %#x, want boot device flag cleared", m.info.Flags)
+	}
+
+	m = New("", "", "", nil, WithBootDevice(0x80, 1, unusedPart, unusedPart))
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoBootDev == 0 {
+		t.Errorf("Flags got %#x, want boot device flag set", m.info.Flags)
+	}
+	if want := uint32(0x8001FFFF); m.info.BootDevice != want {
+		t.Errorf("BootDevice got %#x, want %#x", m.info.BootDevice, want)
+	}
+}
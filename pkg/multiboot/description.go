@@ -10,7 +10,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"strings"
 )
 
 const DebugPrefix = "MULTIBOOT_DEBUG_INFO:"
@@ -39,8 +38,7 @@ type Description struct {
 func (m Multiboot) Description() (string, error) {
 	var modules []ModuleDesc
 	for i, mod := range m.loadedModules {
-		name := strings.Fields(m.modules[i])[0]
-		b, err := readFile(name)
+		b, err := readModule(m.modules[i], AlwaysDecompress, m.maxModuleSize)
 		if err != nil {
 			return "", nil
 		}
@@ -48,7 +46,7 @@ func (m Multiboot) Description() (string, error) {
 		modules = append(modules, ModuleDesc{
 			Start:   mod.Start,
 			End:     mod.End,
-			CmdLine: m.modules[i],
+			CmdLine: m.modules[i].CmdLine,
 			SHA256:  fmt.Sprintf("%x", hash),
 		})
 
@@ -62,7 +60,7 @@ func (m Multiboot) Description() (string, error) {
 		MmapAddr:   m.info.MmapAddr,
 		MmapLength: m.info.MmapLength,
 
-		CmdLine:    m.cmdLine,
+		CmdLine:    m.infoCmdLine,
 		Bootloader: m.bootloader,
 
 		Mmap:    m.memoryMap(),
@@ -0,0 +1,85 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// DriveMode is the access mode of a BIOS drive.
+type DriveMode uint8
+
+const (
+	// DriveModeCHS is the traditional cylinder/head/sector mode.
+	DriveModeCHS DriveMode = 0
+	// DriveModeLBA is the Logical Block Addressing mode.
+	DriveModeLBA DriveMode = 1
+)
+
+// Drive describes a BIOS drive passed to the kernel in the drives
+// info, as defined in
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Boot-information-format.
+type Drive struct {
+	// Number is the BIOS drive number, e.g. 0x80 for the first hard disk.
+	Number uint8
+	Mode   DriveMode
+
+	// Cylinders, Heads and Sectors are the drive geometry
+	// detected by the BIOS.
+	Cylinders uint16
+	Heads     uint8
+	Sectors   uint8
+
+	// Ports are the I/O ports used for the drive in the BIOS code.
+	Ports []uint16
+}
+
+// sizeofDriveHeader is the size of the fixed part of a drive structure.
+const sizeofDriveHeader = 10
+
+type drives []Drive
+
+// marshal writes out the drive structures, each starting with
+// its size and ending with a zero-terminated port array.
+func (d drives) marshal(order binary.ByteOrder) ([]byte, error) {
+	buf := bytes.Buffer{}
+	for _, drive := range d {
+		size := sizeofDriveHeader + 2*(len(drive.Ports)+1)
+		for _, p := range drive.Ports {
+			if p == 0 {
+				return nil, fmt.Errorf("drive %#x has port 0, which terminates the port array", drive.Number)
+			}
+		}
+		for _, v := range []interface{}{
+			uint32(size),
+			drive.Number,
+			drive.Mode,
+			drive.Cylinders,
+			drive.Heads,
+			drive.Sectors,
+			drive.Ports,
+			uint16(0),
+		} {
+			if err := binary.Write(&buf, order, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Multiboot) addDrives() (addr uintptr, size uint, err error) {
+	d, err := drives(m.drives).marshal(m.byteOrder)
+	if err != nil {
+		return 0, 0, err
+	}
+	addr, err = m.mem.AddKexecSegmentIn(d, below4G)
+	if err != nil {
+		return 0, 0, err
+	}
+	return addr, uint(len(d)), nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWithDrives(t *testing.T) {
+	m := New("", "", "", nil)
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoDriveInfo != 0 {
+		t.Errorf("Flags got %#x, want drives flag cleared", m.info.Flags)
+	}
+
+	m = New("", "", "", nil, WithDrives([]Drive{
+		{Number: 0x80, Mode: DriveModeLBA, Cylinders: 1024, Heads: 255, Sectors: 63, Ports: []uint16{0x1f0, 0x3f6}},
+		{Number: 0x81, Mode: DriveModeCHS, Cylinders: 80, Heads: 2, Sectors: 18},
+	}))
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoDriveInfo == 0 {
+		t.Fatalf("Flags got %#x, want drives flag set", m.info.Flags)
+	}
+
+	want := []byte{
+		16, 0, 0, 0, 0x80, 1, 0x00, 0x04, 255, 63, 0xf0, 0x01, 0xf6, 0x03, 0, 0,
+		12, 0, 0, 0, 0x81, 0, 80, 0, 2, 18, 0, 0,
+	}
+	if m.info.DrivesLength != uint32(len(want)) {
+		t.Fatalf("DrivesLength got %d, want %d", m.info.DrivesLength, len(want))
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(m.info.DrivesAddr), len(want)); !bytes.Equal(got, want) {
+		t.Errorf("drives got %#v, want %#v", got, want)
+	}
+}
+
+func TestDrivesMarshalZeroPort(t *testing.T) {
+	d := drives{{Number: 0x80, Ports: []uint16{0x1f0, 0}}}
+	if _, err := d.marshal(binary.LittleEndian); err == nil {
+		t.Errorf("marshal() with port 0 got nil error, want error")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// WriteELF writes the loaded image to w as an ELF file, which contains
+// a PT_LOAD program header for each kexec segment at its physical address
+// and EntryPoint as the entry point.
+//
+// The file can be booted by emulators, e.g. with qemu -kernel.
+func (m Multiboot) WriteELF(w io.Writer) error {
+	segs := append([]kexec.Segment(nil), m.Segments()...)
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].Phys.Start < segs[j].Phys.Start
+	})
+
+	ehdrSize := binary.Size(elf.Header64{})
+	phdrSize := binary.Size(elf.Prog64{})
+
+	ehdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     uint64(m.EntryPoint),
+		Phoff:     uint64(ehdrSize),
+		Ehsize:    uint16(ehdrSize),
+		Phentsize: uint16(phdrSize),
+		Phnum:     uint16(len(segs)),
+	}
+	copy(ehdr.Ident[:], elf.ELFMAG)
+	ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, binary.LittleEndian, ehdr); err != nil {
+		return err
+	}
+
+	off := uint64(ehdrSize + len(segs)*phdrSize)
+	for _, s := range segs {
+		phdr := elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+			Off:    off,
+			Vaddr:  uint64(s.Phys.Start),
+			Paddr:  uint64(s.Phys.Start),
+			Filesz: uint64(s.Buf.Size),
+			Memsz:  uint64(s.Phys.Size),
+		}
+		if err := binary.Write(&buf, binary.LittleEndian, phdr); err != nil {
+			return err
+		}
+		off += uint64(s.Buf.Size)
+	}
+	for _, s := range segs {
+		if _, err := buf.Write(s.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
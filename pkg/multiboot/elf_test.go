@@ -0,0 +1,59 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+func TestWriteELF(t *testing.T) {
+	m := New("", "", "", nil)
+	m.mem.Segments = []kexec.Segment{
+		kexec.NewSegment([]byte("trampoline"), kexec.Range{Start: 0x200000, Size: 0x1000}),
+		kexec.NewSegment([]byte("kernel"), kexec.Range{Start: 0x100000, Size: 0x2000}),
+	}
+	m.EntryPoint = 0x200000
+
+	buf := bytes.Buffer{}
+	if err := m.WriteELF(&buf); err != nil {
+		t.Fatalf("WriteELF() error: %v", err)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Cannot parse ELF: %v", err)
+	}
+	if f.Entry != 0x200000 {
+		t.Errorf("Entry got %#x, want %#x", f.Entry, 0x200000)
+	}
+	for i, want := range []struct {
+		paddr uint64
+		memsz uint64
+		data  string
+	}{
+		{paddr: 0x100000, memsz: 0x2000, data: "kernel"},
+		{paddr: 0x200000, memsz: 0x1000, data: "trampoline"},
+	} {
+		if i >= len(f.Progs) {
+			t.Fatalf("ELF got %d program headers, want 2", len(f.Progs))
+		}
+		p := f.Progs[i]
+		if p.Type != elf.PT_LOAD || p.Paddr != want.paddr || p.Memsz != want.memsz {
+			t.Errorf("program header %d: got %+v, want paddr %#x, memsz %#x", i, p.ProgHeader, want.paddr, want.memsz)
+		}
+		data, err := ioutil.ReadAll(p.Open())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want.data {
+			t.Errorf("program header %d: got data %q, want %q", i, data, want.data)
+		}
+	}
+}
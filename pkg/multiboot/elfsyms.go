@@ -0,0 +1,128 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// sectionHeaders is the section header table of an ELF kernel
+// together with the symbol and string tables not loaded with the kernel.
+type sectionHeaders struct {
+	// table is the raw section header table.
+	table    []byte
+	num      uint32
+	entSize  uint32
+	shstrndx uint32
+
+	class elf.Class
+	order binary.ByteOrder
+
+	// sections stores the content of each section to be copied,
+	// indexed by section number. Other sections are nil.
+	sections [][]byte
+}
+
+// readSectionHeaders reads the section header table of the ELF kernel b.
+// It returns nil if the kernel has no section headers.
+func readSectionHeaders(b []byte) (*sectionHeaders, error) {
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	var shoff uint64
+	sh := &sectionHeaders{class: f.Class, order: f.ByteOrder}
+	r := bytes.NewReader(b)
+	switch f.Class {
+	case elf.ELFCLASS32:
+		var hdr elf.Header32
+		if err := binary.Read(r, f.ByteOrder, &hdr); err != nil {
+			return nil, err
+		}
+		shoff = uint64(hdr.Shoff)
+		sh.num, sh.entSize, sh.shstrndx = uint32(hdr.Shnum), uint32(hdr.Shentsize), uint32(hdr.Shstrndx)
+	case elf.ELFCLASS64:
+		var hdr elf.Header64
+		if err := binary.Read(r, f.ByteOrder, &hdr); err != nil {
+			return nil, err
+		}
+		shoff = hdr.Shoff
+		sh.num, sh.entSize, sh.shstrndx = uint32(hdr.Shnum), uint32(hdr.Shentsize), uint32(hdr.Shstrndx)
+	default:
+		return nil, fmt.Errorf("unknown ELF class %v", f.Class)
+	}
+	if sh.num == 0 {
+		return nil, nil
+	}
+
+	size := uint64(sh.num) * uint64(sh.entSize)
+	if shoff+size > uint64(len(b)) {
+		return nil, fmt.Errorf("section header table at %#x is beyond the end of the kernel", shoff)
+	}
+	sh.table = make([]byte, size)
+	copy(sh.table, b[shoff:])
+
+	sh.sections = make([][]byte, len(f.Sections))
+	for i, s := range f.Sections {
+		if s.Type != elf.SHT_SYMTAB && s.Type != elf.SHT_STRTAB {
+			continue
+		}
+		// Allocated sections are loaded with the kernel.
+		if s.Flags&elf.SHF_ALLOC != 0 {
+			continue
+		}
+		if s.Offset+s.Size > uint64(len(b)) {
+			return nil, fmt.Errorf("section %q is beyond the end of the kernel", s.Name)
+		}
+		sh.sections[i] = b[s.Offset : s.Offset+s.Size]
+	}
+	return sh, nil
+}
+
+// setAddr sets the address of section i in the section header table.
+func (sh *sectionHeaders) setAddr(i int, addr uintptr) {
+	off := uint32(i) * sh.entSize
+	if sh.class == elf.ELFCLASS32 {
+		sh.order.PutUint32(sh.table[off+12:], uint32(addr))
+	} else {
+		sh.order.PutUint64(sh.table[off+16:], uint64(addr))
+	}
+}
+
+// addSectionHeaders copies the symbol and string tables and the
+// section header table of the kernel to kexec segments and returns
+// the ELF section header table symbols of the multiboot info.
+func (m *Multiboot) addSectionHeaders() ([4]uint32, error) {
+	sh := m.sectionHeaders
+	for i, d := range sh.sections {
+		if len(d) == 0 {
+			continue
+		}
+		addr, err := m.mem.AddKexecSegmentIn(d, below4G)
+		if err != nil {
+			return [4]uint32{}, err
+		}
+		// ELF32 section headers hold 32-bit addresses.
+		if sh.class == elf.ELFCLASS32 {
+			if _, err := addr32(fmt.Sprintf("section %d", i), addr, uint(len(d))); err != nil {
+				return [4]uint32{}, err
+			}
+		}
+		sh.setAddr(i, addr)
+	}
+	addr, err := m.mem.AddKexecSegmentIn(sh.table, below4G)
+	if err != nil {
+		return [4]uint32{}, err
+	}
+	table, err := addr32("section header table", addr, uint(len(sh.table)))
+	if err != nil {
+		return [4]uint32{}, err
+	}
+	return [4]uint32{sh.num, sh.entSize, table, sh.shstrndx}, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// addSections appends a section header table with a null section
+// and a section name string table to the 32-bit ELF kernel b.
+func addSections(t *testing.T, b []byte, shstrtab []byte) []byte {
+	var ehdr elf.Header32
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &ehdr); err != nil {
+		t.Fatal(err)
+	}
+	shstrtabOff := len(b)
+	b = append(b, shstrtab...)
+
+	ehdr.Shoff = uint32(len(b))
+	ehdr.Shentsize = uint16(binary.Size(elf.Section32{}))
+	ehdr.Shnum = 2
+	ehdr.Shstrndx = 1
+	w := bytes.Buffer{}
+	for _, v := range []interface{}{
+		elf.Section32{},
+		elf.Section32{
+			Name:      1,
+			Type:      uint32(elf.SHT_STRTAB),
+			Off:       uint32(shstrtabOff),
+			Size:      uint32(len(shstrtab)),
+			Addralign: 1,
+		},
+	} {
+		if err := binary.Write(&w, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b = append(b, w.Bytes()...)
+
+	w.Reset()
+	if err := binary.Write(&w, binary.LittleEndian, ehdr); err != nil {
+		t.Fatal(err)
+	}
+	copy(b, w.Bytes())
+	return b
+}
+
+func TestSectionHeaders(t *testing.T) {
+	b, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	shstrtab := []byte("\x00.shstrtab\x00")
+	b = addSections(t, b, shstrtab)
+
+	m := New("", "", "", nil)
+	m.mem.Phys = testMemory
+	if m.header, err = parseHeader(bytes.NewReader(b)); err != nil {
+		t.Fatalf("parseHeader() error: %v", err)
+	}
+	if m.sectionHeaders, err = readSectionHeaders(b); err != nil {
+		t.Fatalf("readSectionHeaders() error: %v", err)
+	}
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	if m.info.Flags&flagInfoElfSHDR == 0 {
+		t.Fatalf("Flags got %#x, want ELF section header flag set", m.info.Flags)
+	}
+	entSize := uint32(binary.Size(elf.Section32{}))
+	if num, size, shndx := m.info.Syms[0], m.info.Syms[1], m.info.Syms[3]; num != 2 || size != entSize || shndx != 1 {
+		t.Errorf("Syms got num %d, size %d, shndx %d, want 2, %d, 1", num, size, shndx, entSize)
+	}
+
+	table := segmentData(t, m.mem.Segments, uintptr(m.info.Syms[2]), int(2*entSize))
+	var sections [2]elf.Section32
+	if err := binary.Read(bytes.NewReader(table), binary.LittleEndian, &sections); err != nil {
+		t.Fatal(err)
+	}
+	addr := sections[1].Addr
+	if addr == 0 {
+		t.Fatalf("section name string table address is not set")
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(addr), len(shstrtab)); !bytes.Equal(got, shstrtab) {
+		t.Errorf("section name string table got %q, want %q", got, shstrtab)
+	}
+}
+
+func TestNoSectionHeaders(t *testing.T) {
+	b, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	sh, err := readSectionHeaders(b)
+	if err != nil {
+		t.Fatalf("readSectionHeaders() error: %v", err)
+	}
+	if sh != nil {
+		t.Errorf("readSectionHeaders() got %+v, want nil", sh)
+	}
+}
+
+func TestSymbolFile(t *testing.T) {
+	trampoline := testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The test kernel has no section headers, like a stripped kernel.
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	shstrtab := []byte("\x00.shstrtab\x00")
+	symbols := filepath.Join(dir, "kernel.debug")
+	if err := ioutil.WriteFile(symbols, addSections(t, kernel, shstrtab), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(name, "", trampoline, nil, WithMemoryMap(testMemory))
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if m.info.Flags&flagInfoElfSHDR != 0 {
+		t.Errorf("Flags got %#x, want ELF section header flag unset for stripped kernel", m.info.Flags)
+	}
+
+	m = New(name, "", trampoline, nil, WithMemoryMap(testMemory), WithSymbolFile(symbols))
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if m.info.Flags&flagInfoElfSHDR == 0 {
+		t.Fatalf("Flags got %#x, want ELF section header flag set", m.info.Flags)
+	}
+	entSize := uint32(binary.Size(elf.Section32{}))
+	if num := m.info.Syms[0]; num != 2 {
+		t.Errorf("Syms got num %d, want 2", num)
+	}
+	table := segmentData(t, m.mem.Segments, uintptr(m.info.Syms[2]), int(2*entSize))
+	var sections [2]elf.Section32
+	if err := binary.Read(bytes.NewReader(table), binary.LittleEndian, &sections); err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(sections[1].Addr), len(shstrtab)); !bytes.Equal(got, shstrtab) {
+		t.Errorf("section name string table got %q, want %q", got, shstrtab)
+	}
+
+	m = New(name, "", trampoline, nil, WithMemoryMap(testMemory), WithSymbolFile(filepath.Join(dir, "missing")))
+	if err := m.Load(false); err == nil {
+		t.Errorf("Load() with missing symbol file got nil error, want error")
+	}
+}
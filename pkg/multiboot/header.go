@@ -10,8 +10,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 
 	"github.com/u-root/u-root/pkg/ubinary"
 )
@@ -19,16 +19,36 @@ import (
 var ErrHeaderNotFound = errors.New("multiboot header not found")
 var ErrFlagsNotSupported = errors.New("multiboot header flags not supported yet")
 
+// ErrBadChecksum is returned when a multiboot header magic is found,
+// but the checksum of the header is not valid.
+type ErrBadChecksum struct {
+	Flags    Flag
+	Checksum uint32
+	// Uninitialized is true if both flags and checksum are zero,
+	// which usually indicates a misconfigured kernel build.
+	Uninitialized bool
+}
+
+func (e ErrBadChecksum) Error() string {
+	if e.Uninitialized {
+		return "multiboot header magic found, but flags and checksum are zero; check the kernel build configuration"
+	}
+	return fmt.Sprintf("multiboot header magic found, but checksum %#x is not valid for flags %#x", e.Checksum, e.Flags)
+}
+
 const headerMagic = 0x1BADB002
 
 const (
 	flagHeaderPageAlign  Flag = 0x00000001
 	flagHeaderMemoryInfo      = 0x00000002
 
-	// ignore this flag for now
 	flagHeaderMultibootVideoMode = 0x00000004
 
 	flagHeaderUnsupported = 0x0000FFF8
+
+	// flagHeaderAoutKludge is set if the kernel is loaded using
+	// the address fields of the header instead of the ELF headers.
+	flagHeaderAoutKludge = 0x00010000
 )
 
 // mandatory is a mandatory part of Multiboot v1 header.
@@ -58,9 +78,55 @@ type Header struct {
 	optional
 }
 
+// headerFlagNames are the names of the header flags by bit.
+var headerFlagNames = []string{
+	0:  "PAGE_ALIGN",
+	1:  "MEMORY_INFO",
+	2:  "VIDEO_MODE",
+	16: "AOUT_KLUDGE",
+}
+
+// String returns the flags and the fields of the header they enable.
+func (h Header) String() string {
+	s := fmt.Sprintf("magic %#x, flags %s, checksum %#x", h.Magic, flagString(h.Flags, headerFlagNames), h.Checksum)
+	if h.Flags&flagHeaderAoutKludge != 0 {
+		s += fmt.Sprintf(", header %#x, load %#x-%#x, bss end %#x, entry %#x",
+			h.HeaderAddr, h.LoadAddr, h.LoadEndAddr, h.BSSEndAddr, h.EntryAddr)
+	}
+	if h.Flags&flagHeaderMultibootVideoMode != 0 {
+		s += fmt.Sprintf(", video mode type %d %dx%dx%d", h.ModeType, h.Width, h.Height, h.Depth)
+	}
+	return s
+}
+
+// Valid returns an error if h does not have the multiboot magic or
+// if its checksum is not valid, i.e. if the unsigned 32-bit sum of the
+// magic, the flags and the checksum is not zero.
+// Use it to check a header before writing it into an OS image.
+func (h Header) Valid() error {
+	if h.Magic != headerMagic {
+		return fmt.Errorf("multiboot header magic is %#x, want %#x", h.Magic, uint32(headerMagic))
+	}
+	if h.Magic+uint32(h.Flags)+h.Checksum != 0 {
+		return ErrBadChecksum{
+			Flags:         h.Flags,
+			Checksum:      h.Checksum,
+			Uninitialized: h.Flags == 0 && h.Checksum == 0,
+		}
+	}
+	return nil
+}
+
 // parseHeader parses multiboot header as defined in
 // https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#OS-image-format
 func parseHeader(r io.Reader) (Header, error) {
+	hdr, _, err := findHeader(r)
+	return hdr, err
+}
+
+// findHeader parses multiboot header and returns
+// its offset from the beginning of the OS image.
+func findHeader(r io.Reader) (Header, int, error) {
 	mandatorySize := binary.Size(mandatory{})
 	optionalSize := binary.Size(optional{})
 	sizeofHeader := mandatorySize + optionalSize
@@ -70,7 +136,7 @@ func parseHeader(r io.Reader) (Header, error) {
 	buf := make([]byte, 8192)
 	n, err := io.ReadAtLeast(r, buf, mandatorySize)
 	if err != nil {
-		return hdr, err
+		return hdr, 0, err
 	}
 	buf = buf[:n]
 
@@ -79,22 +145,31 @@ func parseHeader(r io.Reader) (Header, error) {
 	// part of the header starts near the 8192 boundary.
 	buf = append(buf, make([]byte, optionalSize)...)
 	br := new(bytes.Reader)
+	var off int
+	var badChecksum *ErrBadChecksum
 	for len(buf) >= sizeofHeader {
 		br.Reset(buf)
 		if err := binary.Read(br, ubinary.NativeEndian, &hdr); err != nil {
-			return hdr, err
+			return hdr, 0, err
 		}
-		if hdr.Magic == headerMagic && (hdr.Magic+uint32(hdr.Flags)+hdr.Checksum) == 0 {
-			if hdr.Flags&flagHeaderUnsupported != 0 {
-				return hdr, ErrFlagsNotSupported
+		if hdr.Magic == headerMagic {
+			err := hdr.Valid()
+			if err == nil {
+				if hdr.Flags&flagHeaderUnsupported != 0 {
+					return hdr, off, ErrFlagsNotSupported
+				}
+				return hdr, off, nil
 			}
-			if hdr.Flags&flagHeaderMultibootVideoMode != 0 {
-				log.Print("VideoMode flag is not supproted yet, trying to load anyway")
+			if e, ok := err.(ErrBadChecksum); ok && badChecksum == nil {
+				badChecksum = &e
 			}
-			return hdr, nil
 		}
 		// The Multiboot header must be 32-bit aligned.
 		buf = buf[4:]
+		off += 4
+	}
+	if badChecksum != nil {
+		return hdr, 0, *badChecksum
 	}
-	return hdr, ErrHeaderNotFound
+	return hdr, 0, ErrHeaderNotFound
 }
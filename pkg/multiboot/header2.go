@@ -0,0 +1,174 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/u-root/u-root/pkg/ubinary"
+)
+
+// Multiboot2 header as defined in
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html#Header-layout
+
+// ErrMultiboot2NotSupported is returned when loading a multiboot2 kernel.
+// Load has no multiboot2 info-building path yet, it only parses the header.
+var ErrMultiboot2NotSupported = errors.New("multiboot2 kernels are not supported yet")
+
+const header2Magic = 0xE85250D6
+
+// header2Search is the size of the beginning of the OS image,
+// which must contain the multiboot2 header.
+const header2Search = 32768
+
+// Multiboot2 header tag types.
+const (
+	tag2End         = 0
+	tag2InfoRequest = 1
+	tag2Address     = 2
+	tag2EntryAddr   = 3
+	tag2Framebuffer = 5
+	tag2ModuleAlign = 6
+)
+
+// tag2Optional is set in the tag flags if the tag may be ignored.
+const tag2Optional = 1
+
+// mandatory2 is a mandatory part of Multiboot2 header.
+type mandatory2 struct {
+	Magic        uint32
+	Architecture uint32
+	HeaderLength uint32
+	Checksum     uint32
+}
+
+type tag2 struct {
+	Type  uint16
+	Flags uint16
+	Size  uint32
+}
+
+// Address2 is the load address information of a Multiboot2 header.
+type Address2 struct {
+	HeaderAddr  uint32
+	LoadAddr    uint32
+	LoadEndAddr uint32
+	BSSEndAddr  uint32
+}
+
+// Framebuffer2 is the preferred graphics mode of a Multiboot2 header.
+type Framebuffer2 struct {
+	Width  uint32
+	Height uint32
+	Depth  uint32
+}
+
+// Header2 represents a Multiboot2 header loaded from the file.
+type Header2 struct {
+	mandatory2
+
+	// InfoRequests lists the requested boot information tag types.
+	InfoRequests []uint32
+	// Address is set if the header has an address tag.
+	Address *Address2
+	// EntryAddr is set if the header has an entry address tag.
+	EntryAddr *uint32
+	// Framebuffer is set if the header has a framebuffer tag.
+	Framebuffer *Framebuffer2
+	// ModuleAlign is true if modules must be page aligned.
+	ModuleAlign bool
+}
+
+// ParseHeader2 parses multiboot2 header as defined in
+// https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html#OS-image-format
+//
+// It returns ErrHeaderNotFound if r has no multiboot2 header. Other
+// errors mean a multiboot2 header was found, but it is not valid,
+// e.g. it has a required tag, which is not supported.
+func ParseHeader2(r io.Reader) (*Header2, error) {
+	mandatorySize := binary.Size(mandatory2{})
+	buf := make([]byte, header2Search)
+	n, err := io.ReadAtLeast(r, buf, mandatorySize)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrHeaderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	// The Multiboot2 header must be 64-bit aligned.
+	for off := 0; off+mandatorySize <= len(buf); off += 8 {
+		var m mandatory2
+		if err := binary.Read(bytes.NewReader(buf[off:]), ubinary.NativeEndian, &m); err != nil {
+			return nil, err
+		}
+		if m.Magic != header2Magic || m.Magic+m.Architecture+m.HeaderLength+m.Checksum != 0 {
+			continue
+		}
+		if m.HeaderLength < uint32(mandatorySize) || uint64(off)+uint64(m.HeaderLength) > uint64(len(buf)) {
+			return nil, fmt.Errorf("multiboot2 header length %d is out of bounds", m.HeaderLength)
+		}
+		hdr := &Header2{mandatory2: m}
+		if err := hdr.parseTags(buf[off+mandatorySize : off+int(m.HeaderLength)]); err != nil {
+			return nil, err
+		}
+		return hdr, nil
+	}
+	return nil, ErrHeaderNotFound
+}
+
+func (h *Header2) parseTags(b []byte) error {
+	tagSize := binary.Size(tag2{})
+	for len(b) >= tagSize {
+		var t tag2
+		if err := binary.Read(bytes.NewReader(b), ubinary.NativeEndian, &t); err != nil {
+			return err
+		}
+		if t.Size < uint32(tagSize) || uint64(t.Size) > uint64(len(b)) {
+			return fmt.Errorf("multiboot2 header tag %d has invalid size %d", t.Type, t.Size)
+		}
+		body := bytes.NewReader(b[tagSize:t.Size])
+
+		var err error
+		switch t.Type {
+		case tag2End:
+			return nil
+		case tag2InfoRequest:
+			h.InfoRequests = make([]uint32, body.Len()/4)
+			err = binary.Read(body, ubinary.NativeEndian, h.InfoRequests)
+		case tag2Address:
+			h.Address = &Address2{}
+			err = binary.Read(body, ubinary.NativeEndian, h.Address)
+		case tag2EntryAddr:
+			h.EntryAddr = new(uint32)
+			err = binary.Read(body, ubinary.NativeEndian, h.EntryAddr)
+		case tag2Framebuffer:
+			h.Framebuffer = &Framebuffer2{}
+			err = binary.Read(body, ubinary.NativeEndian, h.Framebuffer)
+		case tag2ModuleAlign:
+			h.ModuleAlign = true
+		default:
+			if t.Flags&tag2Optional == 0 {
+				return fmt.Errorf("multiboot2 header tag %d is required, but not supported", t.Type)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("cannot parse multiboot2 header tag %d: %v", t.Type, err)
+		}
+
+		// Tags are padded to be 8 bytes aligned.
+		next := (int(t.Size) + 7) &^ 7
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return fmt.Errorf("multiboot2 header has no end tag")
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// createHeader2 returns a multiboot2 header with tags at offset
+// in a buffer of size bytes.
+func createHeader2(t *testing.T, offset, size int, tags ...interface{}) []byte {
+	body := bytes.Buffer{}
+	for _, tag := range tags {
+		if err := binary.Write(&body, binary.LittleEndian, tag); err != nil {
+			t.Fatal(err)
+		}
+		body.Write(make([]byte, (body.Len()+7)&^7-body.Len()))
+	}
+	length := uint32(binary.Size(mandatory2{}) + body.Len())
+	hdr := bytes.Buffer{}
+	if err := binary.Write(&hdr, binary.LittleEndian, mandatory2{
+		Magic:        header2Magic,
+		HeaderLength: length,
+		Checksum:     -(header2Magic + length),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hdr.Write(body.Bytes())
+
+	buf := make([]byte, size)
+	copy(buf[offset:], hdr.Bytes())
+	return buf
+}
+
+type addressTag2 struct {
+	tag2
+	Address2
+}
+
+type entryTag2 struct {
+	tag2
+	EntryAddr uint32
+}
+
+type infoRequestTag2 struct {
+	tag2
+	Types [2]uint32
+}
+
+var endTag2 = tag2{Type: tag2End, Size: 8}
+
+func TestParseHeader2(t *testing.T) {
+	entry := uint32(0x100040)
+	for _, test := range []struct {
+		name    string
+		buf     []byte
+		want    *Header2
+		wantErr bool
+	}{
+		{
+			name: "tags",
+			buf: createHeader2(t, 4096, 8192,
+				infoRequestTag2{tag2: tag2{Type: tag2InfoRequest, Size: 16}, Types: [2]uint32{4, 6}},
+				addressTag2{tag2: tag2{Type: tag2Address, Size: 24}, Address2: Address2{HeaderAddr: 1, LoadAddr: 2, LoadEndAddr: 3, BSSEndAddr: 4}},
+				entryTag2{tag2: tag2{Type: tag2EntryAddr, Size: 12}, EntryAddr: entry},
+				tag2{Type: tag2ModuleAlign, Size: 8},
+				endTag2,
+			),
+			want: &Header2{
+				InfoRequests: []uint32{4, 6},
+				Address:      &Address2{HeaderAddr: 1, LoadAddr: 2, LoadEndAddr: 3, BSSEndAddr: 4},
+				EntryAddr:    &entry,
+				ModuleAlign:  true,
+			},
+		},
+		{
+			name: "optional_unknown",
+			buf:  createHeader2(t, 0, 8192, tag2{Type: 42, Flags: tag2Optional, Size: 8}, endTag2),
+			want: &Header2{},
+		},
+		{
+			name:    "required_unknown",
+			buf:     createHeader2(t, 0, 8192, tag2{Type: 42, Size: 8}, endTag2),
+			wantErr: true,
+		},
+		{
+			name:    "no_end_tag",
+			buf:     createHeader2(t, 0, 8192, tag2{Type: tag2ModuleAlign, Size: 8}),
+			wantErr: true,
+		},
+		{
+			name:    "beyond_32k",
+			buf:     createHeader2(t, 32768, 40000, endTag2),
+			wantErr: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseHeader2(bytes.NewReader(test.buf))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseHeader2() got error %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			test.want.mandatory2 = got.mandatory2
+			if got.Magic != header2Magic {
+				t.Errorf("ParseHeader2() got magic %#x, want %#x", got.Magic, uint32(header2Magic))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseHeader2() got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadMultiboot2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot2")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name string
+		buf  []byte
+		want string
+	}{
+		{
+			name: "supported",
+			buf:  createHeader2(t, 0, 8192, endTag2),
+			want: ErrMultiboot2NotSupported.Error(),
+		},
+		{
+			name: "required_unknown",
+			buf:  createHeader2(t, 0, 8192, tag2{Type: 42, Size: 8}, endTag2),
+			want: "multiboot2 header tag 42 is required, but not supported",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(path, test.buf, 0644); err != nil {
+				t.Fatal(err)
+			}
+			m := New(path, "", "", nil, WithMemoryMap(testMemory))
+			err := m.Load(false)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Load() got error %v, want error containing %q", err, test.want)
+			}
+		})
+	}
+}
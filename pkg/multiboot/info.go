@@ -9,6 +9,10 @@ package multiboot
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"strings"
 
 	"github.com/u-root/u-root/pkg/ubinary"
 )
@@ -39,7 +43,6 @@ type Info struct {
 	MemLower uint32
 	MemUpper uint32
 
-	// BootDevice is not supported, always zero.
 	BootDevice uint32
 
 	CmdLine uint32
@@ -47,17 +50,17 @@ type Info struct {
 	ModsCount uint32
 	ModsAddr  uint32
 
-	// Syms is not supported, always zero array.
+	// Syms is the ELF section header table: number of entries,
+	// size of an entry, address and string table index.
 	Syms [4]uint32
 
 	MmapLength uint32
 	MmapAddr   uint32
 
-	// Following fields except BootLoaderName are not suppoted yet,
-	// the values are always set to zeros.
-
-	DriversLength uint32
-	DrivesrAddr   uint32
+	// DrivesLength is the total size of the drive structures
+	// at DrivesAddr.
+	DrivesLength uint32
+	DrivesAddr   uint32
 
 	ConfigTable uint32
 
@@ -65,6 +68,7 @@ type Info struct {
 
 	APMTable uint32
 
+	// VBE fields are not supported, always zero.
 	VBEControlInfo  uint32
 	VBEModeInfo     uint32
 	VBEMode         uint16
@@ -72,8 +76,8 @@ type Info struct {
 	VBEInterfaceOff uint16
 	VBEInterfaceLen uint16
 
-	FramebufferAddr   uint16
-	FramebufferPitch  uint16
+	FramebufferAddr   uint64
+	FramebufferPitch  uint32
 	FramebufferWidth  uint32
 	FramebufferHeight uint32
 	FramebufferBPP    byte
@@ -81,40 +85,309 @@ type Info struct {
 	ColorInfo         [6]byte
 }
 
+// infoFlagNames are the names of the info flags by bit.
+var infoFlagNames = []string{
+	"MEMORY",
+	"BOOTDEV",
+	"CMDLINE",
+	"MODS",
+	"AOUT_SYMS",
+	"ELF_SHDR",
+	"MMAP",
+	"DRIVES",
+	"CONFIG_TABLE",
+	"BOOT_LOADER_NAME",
+	"APM_TABLE",
+	"VBE",
+	"FRAMEBUFFER",
+}
+
+// flagString returns the names of the bits set in f joined with "|".
+// Bits without a name are printed in hex.
+func flagString(f Flag, names []string) string {
+	var s []string
+	for i, name := range names {
+		if name != "" && f&(1<<uint(i)) != 0 {
+			s = append(s, name)
+			f &^= 1 << uint(i)
+		}
+	}
+	if f != 0 || len(s) == 0 {
+		s = append(s, fmt.Sprintf("%#x", uint32(f)))
+	}
+	return strings.Join(s, "|")
+}
+
+// String returns the flags and the fields of the info they enable.
+func (info Info) String() string {
+	s := []string{"flags " + flagString(info.Flags, infoFlagNames)}
+	f := info.Flags
+	if f&flagInfoMemory != 0 {
+		s = append(s, fmt.Sprintf("mem lower %dKB upper %dKB", info.MemLower, info.MemUpper))
+	}
+	if f&flagInfoBootDev != 0 {
+		s = append(s, fmt.Sprintf("boot device %#x", info.BootDevice))
+	}
+	if f&flagInfoCmdLine != 0 {
+		s = append(s, fmt.Sprintf("cmdline %#x", info.CmdLine))
+	}
+	if f&flagInfoMods != 0 {
+		s = append(s, fmt.Sprintf("%d mods at %#x", info.ModsCount, info.ModsAddr))
+	}
+	if f&flagInfoAoutSyms != 0 {
+		s = append(s, fmt.Sprintf("a.out syms tabsize %#x strsize %#x at %#x", info.Syms[0], info.Syms[1], info.Syms[2]))
+	}
+	if f&flagInfoElfSHDR != 0 {
+		s = append(s, fmt.Sprintf("ELF %d section headers of %d bytes at %#x, shstrndx %d", info.Syms[0], info.Syms[1], info.Syms[2], info.Syms[3]))
+	}
+	if f&flagInfoMemMap != 0 {
+		s = append(s, fmt.Sprintf("mmap %d bytes at %#x", info.MmapLength, info.MmapAddr))
+	}
+	if f&flagInfoDriveInfo != 0 {
+		s = append(s, fmt.Sprintf("drives %d bytes at %#x", info.DrivesLength, info.DrivesAddr))
+	}
+	if f&flagInfoConfigTable != 0 {
+		s = append(s, fmt.Sprintf("config table %#x", info.ConfigTable))
+	}
+	if f&flagInfoBootLoaderName != 0 {
+		s = append(s, fmt.Sprintf("bootloader name %#x", info.BootLoaderName))
+	}
+	if f&flagInfoAPMTable != 0 {
+		s = append(s, fmt.Sprintf("APM table %#x", info.APMTable))
+	}
+	if f&flagInfoFrameBuffer != 0 {
+		s = append(s, fmt.Sprintf("framebuffer %dx%dx%d type %d pitch %d at %#x",
+			info.FramebufferWidth, info.FramebufferHeight, info.FramebufferBPP, info.FramebufferType, info.FramebufferPitch, info.FramebufferAddr))
+	}
+	return strings.Join(s, ", ")
+}
+
 type infoWrapper struct {
 	Info
 
 	CmdLine        string
 	BootLoaderName string
+
+	// Vendor is appended to the info after the strings.
+	Vendor []byte
+
+	// align is the alignment of the marshaled info size.
+	align uint
+	// order is the byte order of the loaded kernel.
+	order binary.ByteOrder
+
+	// separateStrings is true if the strings are not
+	// marshaled with the info, but stored at stringsAddr.
+	separateStrings bool
+	stringsAddr     uintptr
+
+	// checksum appends the CRC32 of the info structure to it.
+	checksum bool
+
+	// layout is the order of the components placed after the info.
+	// If nil, the command line and the bootloader name follow it.
+	layout []InfoComponent
+	// mmap and mods are the marshaled memory map
+	// and module list placed after the info, if any.
+	mmap []byte
+	mods []byte
+}
+
+// InfoComponent is a part of the multiboot info,
+// which can be placed right after the Info structure.
+type InfoComponent int
+
+const (
+	// InfoCmdLine is the kernel command line.
+	InfoCmdLine InfoComponent = iota
+	// InfoBootLoaderName is the bootloader name.
+	InfoBootLoaderName
+	// InfoMemoryMap is the memory map.
+	InfoMemoryMap
+	// InfoModules is the module list.
+	// The module command lines are stored separately.
+	InfoModules
+)
+
+var infoComponentNames = []string{"cmdline", "bootloader name", "memory map", "modules"}
+
+func (c InfoComponent) String() string {
+	if c >= 0 && int(c) < len(infoComponentNames) {
+		return infoComponentNames[c]
+	}
+	return fmt.Sprintf("InfoComponent(%d)", int(c))
+}
+
+// infoLayout returns the complete layout of the components after
+// the info for the requested order. The command line and the bootloader
+// name are appended if missing, the other components are placed in
+// their own segments if missing.
+func infoLayout(order []InfoComponent) ([]InfoComponent, error) {
+	seen := make(map[InfoComponent]bool)
+	var layout []InfoComponent
+	for _, c := range order {
+		if c < 0 || int(c) >= len(infoComponentNames) {
+			return nil, fmt.Errorf("unknown info component %v", c)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("info component %v is listed twice", c)
+		}
+		seen[c] = true
+		layout = append(layout, c)
+	}
+	for _, c := range []InfoComponent{InfoCmdLine, InfoBootLoaderName} {
+		if !seen[c] {
+			layout = append(layout, c)
+		}
+	}
+	return layout, nil
+}
+
+// sizeofChecksum is the size of the info checksum.
+const sizeofChecksum = 4
+
+// strings returns the NUL terminated command line and bootloader name.
+// The bootloader name is omitted if empty.
+func (iw *infoWrapper) strings() []byte {
+	b := append([]byte(iw.CmdLine), 0)
+	if iw.BootLoaderName != "" {
+		b = append(append(b, iw.BootLoaderName...), 0)
+	}
+	return b
 }
 
 // marshal writes out the exact bytes of multiboot info
 // expected by the kernel being loaded.
 func (iw *infoWrapper) marshal(base uintptr) ([]byte, error) {
-	offset := sizeofInfo + uint32(base)
-	iw.Info.CmdLine = offset
-	offset += uint32(len(iw.CmdLine)) + 1
-	iw.Info.BootLoaderName = offset
-
-	buf := bytes.Buffer{}
-	if err := binary.Write(&buf, ubinary.NativeEndian, iw.Info); err != nil {
-		return nil, err
+	start := uint64(base) + uint64(sizeofInfo)
+	if iw.checksum {
+		start += sizeofChecksum
 	}
-
-	for _, s := range []string{iw.CmdLine, iw.BootLoaderName} {
-		if _, err := buf.WriteString(s); err != nil {
+	var tail []byte
+	if iw.layout != nil {
+		var err error
+		if tail, err = iw.layOut(start); err != nil {
 			return nil, err
 		}
-		if err := buf.WriteByte(0); err != nil {
+	} else {
+		strs := iw.strings()
+		strBase := start
+		if iw.separateStrings {
+			strBase = uint64(iw.stringsAddr)
+		} else {
+			tail = strs
+		}
+		if err := iw.checkStrings(strBase, len(strs)); err != nil {
 			return nil, err
 		}
+		iw.Info.CmdLine = uint32(strBase)
+		iw.Info.BootLoaderName = 0
+		if iw.BootLoaderName != "" {
+			iw.Info.BootLoaderName = uint32(strBase) + uint32(len(iw.CmdLine)) + 1
+		}
 	}
 
-	size := (buf.Len() + 3) &^ 3
+	buf := bytes.Buffer{}
+	if err := writeInfo(&buf, iw.Info, iw.order, iw.checksum); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(tail); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(iw.Vendor); err != nil {
+		return nil, err
+	}
+
+	align := iw.align
+	if align == 0 {
+		align = 4
+	}
+	if align&(align-1) != 0 {
+		return nil, fmt.Errorf("info alignment %d is not a power of two", align)
+	}
+	mask := int(align - 1)
+	size := (buf.Len() + mask) &^ mask
 	_, err := buf.Write(bytes.Repeat([]byte{0}, size-buf.Len()))
 	return buf.Bytes(), err
 }
 
+// writeInfo writes info in the given byte order to buf,
+// followed by its checksum if checksum is true.
+func writeInfo(buf *bytes.Buffer, info Info, order binary.ByteOrder, checksum bool) error {
+	if order == nil {
+		order = ubinary.NativeEndian
+	}
+	start := buf.Len()
+	if err := binary.Write(buf, order, info); err != nil {
+		return err
+	}
+	if checksum {
+		return binary.Write(buf, order, crc32.ChecksumIEEE(buf.Bytes()[start:]))
+	}
+	return nil
+}
+
+// checkStrings checks that size bytes of strings at addr can be
+// pointed to by the info.
+func (iw *infoWrapper) checkStrings(addr uint64, size int) error {
+	if addr+uint64(size) > math.MaxUint32+1 {
+		return fmt.Errorf("multiboot info strings at %#x do not fit below 4GB, their pointers would be truncated", addr)
+	}
+	return nil
+}
+
+// layOut places the components of iw.layout contiguously from address
+// start in their order, sets their pointers in the info and returns
+// their bytes. The memory map and the module list are 4-byte aligned.
+func (iw *infoWrapper) layOut(start uint64) ([]byte, error) {
+	buf := bytes.Buffer{}
+	for _, c := range iw.layout {
+		addr := start + uint64(buf.Len())
+		switch c {
+		case InfoCmdLine:
+			if err := iw.checkStrings(addr, len(iw.CmdLine)+1); err != nil {
+				return nil, err
+			}
+			iw.Info.CmdLine = uint32(addr)
+			buf.WriteString(iw.CmdLine)
+			buf.WriteByte(0)
+
+		case InfoBootLoaderName:
+			iw.Info.BootLoaderName = 0
+			if iw.BootLoaderName == "" {
+				continue
+			}
+			if err := iw.checkStrings(addr, len(iw.BootLoaderName)+1); err != nil {
+				return nil, err
+			}
+			iw.Info.BootLoaderName = uint32(addr)
+			buf.WriteString(iw.BootLoaderName)
+			buf.WriteByte(0)
+
+		case InfoMemoryMap, InfoModules:
+			d, what, ptr := iw.mmap, "memory map", &iw.Info.MmapAddr
+			if c == InfoModules {
+				d, what, ptr = iw.mods, "module list", &iw.Info.ModsAddr
+			}
+			if d == nil {
+				continue
+			}
+			pad := (4 - buf.Len()%4) % 4
+			buf.Write(make([]byte, pad))
+			addr += uint64(pad)
+			if addr+uint64(len(d)) > math.MaxUint32+1 {
+				return nil, fmt.Errorf("%v at %#x does not fit below 4GB", what, addr)
+			}
+			*ptr = uint32(addr)
+			buf.Write(d)
+
+		default:
+			return nil, fmt.Errorf("unknown info component %v", c)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
 func (iw infoWrapper) size() (uint, error) {
 	b, err := iw.marshal(0)
 	return uint(len(b)), err
@@ -0,0 +1,491 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+func TestInfoAlignment(t *testing.T) {
+	const (
+		cmdLine    = "cmdline"
+		bootloader = "bootloader"
+		base       = 0x100000
+	)
+	unaligned := int(sizeofInfo) + len(cmdLine) + 1 + len(bootloader) + 1
+
+	for _, align := range []uint{4, 8, 16} {
+		t.Run(fmt.Sprintf("align:%d", align), func(t *testing.T) {
+			iw := infoWrapper{
+				CmdLine:        cmdLine,
+				BootLoaderName: bootloader,
+				align:          align,
+			}
+			b, err := iw.marshal(base)
+			if err != nil {
+				t.Fatalf("marshal() error: %v", err)
+			}
+			mask := int(align) - 1
+			if want := (unaligned + mask) &^ mask; len(b) != want {
+				t.Errorf("marshal() got %d bytes, want %d", len(b), want)
+			}
+			if want := base + sizeofInfo; iw.Info.CmdLine != want {
+				t.Errorf("CmdLine got %#x, want %#x", iw.Info.CmdLine, want)
+			}
+			if want := base + sizeofInfo + uint32(len(cmdLine)) + 1; iw.Info.BootLoaderName != want {
+				t.Errorf("BootLoaderName got %#x, want %#x", iw.Info.BootLoaderName, want)
+			}
+		})
+	}
+
+	iw := infoWrapper{align: 6}
+	if _, err := iw.marshal(base); err == nil {
+		t.Errorf("marshal() with alignment 6 got nil error, want error")
+	}
+}
+
+func TestMarshalByteOrder(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		order binary.ByteOrder
+		u32   []byte
+		u64   []byte
+	}{
+		{
+			name:  "little",
+			order: binary.LittleEndian,
+			u32:   []byte{0x04, 0x03, 0x02, 0x01},
+			u64:   []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+		},
+		{
+			name:  "big",
+			order: binary.BigEndian,
+			u32:   []byte{0x01, 0x02, 0x03, 0x04},
+			u64:   []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			iw := infoWrapper{
+				Info:  Info{Flags: 0x01020304, MmapAddr: 0x01020304},
+				order: test.order,
+			}
+			b, err := iw.marshal(0)
+			if err != nil {
+				t.Fatalf("infoWrapper.marshal() error: %v", err)
+			}
+			if !bytes.Equal(b[0:4], test.u32) {
+				t.Errorf("Info.Flags got % x, want % x", b[0:4], test.u32)
+			}
+			if !bytes.Equal(b[48:52], test.u32) {
+				t.Errorf("Info.MmapAddr got % x, want % x", b[48:52], test.u32)
+			}
+			// CmdLine is a pointer right after the info.
+			cmdLine := make([]byte, 4)
+			test.order.PutUint32(cmdLine, sizeofInfo)
+			if !bytes.Equal(b[16:20], cmdLine) {
+				t.Errorf("Info.CmdLine got % x, want % x", b[16:20], cmdLine)
+			}
+
+			mmap := memoryMaps{{Size: 0x01020304, BaseAddr: 0x0102030405060708}}
+			if b, err = mmap.marshal(test.order); err != nil {
+				t.Fatalf("memoryMaps.marshal() error: %v", err)
+			}
+			if !bytes.Equal(b[0:4], test.u32) {
+				t.Errorf("MemoryMap.Size got % x, want % x", b[0:4], test.u32)
+			}
+			if !bytes.Equal(b[4:12], test.u64) {
+				t.Errorf("MemoryMap.BaseAddr got % x, want % x", b[4:12], test.u64)
+			}
+
+			mods := modules{{Start: 0x01020304, CmdLine: 0x01020304}}
+			if b, err = mods.marshal(test.order); err != nil {
+				t.Fatalf("modules.marshal() error: %v", err)
+			}
+			if !bytes.Equal(b[0:4], test.u32) {
+				t.Errorf("Module.Start got % x, want % x", b[0:4], test.u32)
+			}
+			if !bytes.Equal(b[8:12], test.u32) {
+				t.Errorf("Module.CmdLine got % x, want % x", b[8:12], test.u32)
+			}
+		})
+	}
+}
+
+func TestWithoutBootLoaderName(t *testing.T) {
+	const cmdLine = "cmdline"
+	m := New("", cmdLine, "", nil, WithoutBootLoaderName())
+	m.mem.Phys = testMemory
+	addr, err := m.addInfo()
+	if err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoBootLoaderName != 0 {
+		t.Errorf("flagInfoBootLoaderName is set")
+	}
+	if m.info.BootLoaderName != 0 {
+		t.Errorf("BootLoaderName got %#x, want 0", m.info.BootLoaderName)
+	}
+	// The info is followed by the command line only.
+	size := int(sizeofInfo) + len(cmdLine) + 1
+	b := segmentData(t, m.mem.Segments, addr, (size+3)&^3)
+	if bytes.Contains(b, []byte(bootloader)) {
+		t.Errorf("info contains bootloader name %q", bootloader)
+	}
+}
+
+func TestWithBootLoaderName(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		bootloader string
+		want       string
+	}{
+		{name: "custom", bootloader: "test loader", want: "test loader"},
+		{name: "empty", bootloader: "", want: bootloader},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := New("", "cmdline", "", nil, WithBootLoaderName(test.bootloader))
+			m.mem.Phys = testMemory
+			if _, err := m.addInfo(); err != nil {
+				t.Fatalf("addInfo() error: %v", err)
+			}
+			if m.info.Flags&flagInfoBootLoaderName == 0 {
+				t.Errorf("flagInfoBootLoaderName is not set")
+			}
+			if got := string(segmentData(t, m.mem.Segments, uintptr(m.info.BootLoaderName), len(test.want)+1)); got != test.want+"\x00" {
+				t.Errorf("bootloader name got %q, want %q", got, test.want+"\x00")
+			}
+		})
+	}
+}
+
+// TestInfoLayout checks the offset and size of each Info field
+// against the boot information format defined in
+// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Boot-information-format.
+func TestInfoLayout(t *testing.T) {
+	spec := []struct {
+		field  string
+		offset int
+		size   int
+	}{
+		{"Flags", 0, 4},
+		{"MemLower", 4, 4},
+		{"MemUpper", 8, 4},
+		{"BootDevice", 12, 4},
+		{"CmdLine", 16, 4},
+		{"ModsCount", 20, 4},
+		{"ModsAddr", 24, 4},
+		{"Syms", 28, 16},
+		{"MmapLength", 44, 4},
+		{"MmapAddr", 48, 4},
+		{"DrivesLength", 52, 4},
+		{"DrivesAddr", 56, 4},
+		{"ConfigTable", 60, 4},
+		{"BootLoaderName", 64, 4},
+		{"APMTable", 68, 4},
+		{"VBEControlInfo", 72, 4},
+		{"VBEModeInfo", 76, 4},
+		{"VBEMode", 80, 2},
+		{"VBEInterfaceSeg", 82, 2},
+		{"VBEInterfaceOff", 84, 2},
+		{"VBEInterfaceLen", 86, 2},
+		{"FramebufferAddr", 88, 8},
+		{"FramebufferPitch", 96, 4},
+		{"FramebufferWidth", 100, 4},
+		{"FramebufferHeight", 104, 4},
+		{"FramebufferBPP", 108, 1},
+		{"FramebufferType", 109, 1},
+		{"ColorInfo", 110, 6},
+	}
+
+	typ := reflect.TypeOf(Info{})
+	if typ.NumField() != len(spec) {
+		t.Errorf("Info has %d fields, spec has %d", typ.NumField(), len(spec))
+	}
+	// Info is marshaled with encoding/binary, which does not pad fields.
+	var offset int
+	for i := 0; i < typ.NumField() && i < len(spec); i++ {
+		f := typ.Field(i)
+		size := binary.Size(reflect.Zero(f.Type).Interface())
+		if want := spec[i]; f.Name != want.field || offset != want.offset || size != want.size {
+			t.Errorf("field %d is %s at offset %d of size %d, want %s at offset %d of size %d",
+				i, f.Name, offset, size, want.field, want.offset, want.size)
+		}
+		offset += size
+	}
+	if want := 116; int(sizeofInfo) != want {
+		t.Errorf("sizeofInfo got %d, want %d", sizeofInfo, want)
+	}
+}
+
+func TestWithVendorInfo(t *testing.T) {
+	const cmdLine = "cmdline"
+	vendor := []byte{0xde, 0xad, 0xbe, 0xef, 0x01}
+	m := New("", cmdLine, "", nil, WithVendorInfo(vendor), WithInfoAlignment(8))
+	m.mem.Phys = testMemory
+	addr, err := m.addInfo()
+	if err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	offset := int(sizeofInfo) + len(cmdLine) + 1 + len(bootloader) + 1
+	b := segmentData(t, m.mem.Segments, addr, offset+len(vendor))
+	if got := b[offset:]; !bytes.Equal(got, vendor) {
+		t.Errorf("vendor info got % x, want % x", got, vendor)
+	}
+}
+
+func TestMarshalAbove4GB(t *testing.T) {
+	const (
+		cmdLine    = "cmdline"
+		bootloader = "bootloader"
+	)
+	iw := infoWrapper{
+		CmdLine:        cmdLine,
+		BootLoaderName: bootloader,
+	}
+
+	// The last string ends exactly at 4GB.
+	size := uint64(sizeofInfo) + uint64(len(cmdLine)) + 1 + uint64(len(bootloader)) + 1
+	base := uintptr(math.MaxUint32 + 1 - size)
+	if _, err := iw.marshal(base); err != nil {
+		t.Errorf("marshal(%#x) error: %v", base, err)
+	}
+	// The bootloader name terminator is above 4GB.
+	if _, err := iw.marshal(base + 1); err == nil {
+		t.Errorf("marshal(%#x) got nil error, want error", base+1)
+	}
+}
+
+func TestWithSeparateInfoStrings(t *testing.T) {
+	const cmdLine = "cmdline"
+	m := New("", cmdLine, "", nil, WithSeparateInfoStrings())
+	m.mem.Phys = testMemory
+	addr, err := m.addInfo()
+	if err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	var info, strs *kexec.Segment
+	for i, s := range m.mem.Segments {
+		switch s.Phys.Start {
+		case addr:
+			info = &m.mem.Segments[i]
+		case uintptr(m.info.CmdLine):
+			strs = &m.mem.Segments[i]
+		}
+	}
+	if info == nil || strs == nil {
+		t.Fatalf("info at %#x and strings at %#x are not in separate segments", addr, m.info.CmdLine)
+	}
+	if want := uint(sizeofInfo); info.Buf.Size != want {
+		t.Errorf("info segment got %d bytes, want %d", info.Buf.Size, want)
+	}
+
+	want := cmdLine + "\x00" + bootloader + "\x00"
+	if got := string(segmentData(t, m.mem.Segments, uintptr(m.info.CmdLine), len(want))); got != want {
+		t.Errorf("strings got %q, want %q", got, want)
+	}
+	if got, want := m.info.BootLoaderName, m.info.CmdLine+uint32(len(cmdLine))+1; got != want {
+		t.Errorf("BootLoaderName got %#x, want %#x", got, want)
+	}
+}
+
+func TestWithInfoChecksum(t *testing.T) {
+	const cmdLine = "cmdline"
+	m := New("", cmdLine, "", nil, WithInfoChecksum(), WithByteOrder(binary.LittleEndian))
+	m.mem.Phys = testMemory
+	addr, err := m.addInfo()
+	if err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	d := segmentData(t, m.mem.Segments, addr, int(sizeofInfo)+sizeofChecksum)
+	buf := bytes.Buffer{}
+	if err := binary.Write(&buf, binary.LittleEndian, m.info); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d[:sizeofInfo], buf.Bytes()) {
+		t.Fatalf("marshaled info does not match Info %v", m.info)
+	}
+	if got, want := binary.LittleEndian.Uint32(d[sizeofInfo:]), crc32.ChecksumIEEE(buf.Bytes()); got != want {
+		t.Errorf("checksum got %#x, want %#x", got, want)
+	}
+
+	if got, want := m.info.CmdLine, uint32(addr)+sizeofInfo+sizeofChecksum; got != want {
+		t.Errorf("CmdLine got %#x, want %#x", got, want)
+	}
+	want := cmdLine + "\x00" + bootloader + "\x00"
+	if got := string(segmentData(t, m.mem.Segments, uintptr(m.info.CmdLine), len(want))); got != want {
+		t.Errorf("strings got %q, want %q", got, want)
+	}
+}
+
+func TestPreviewInfo(t *testing.T) {
+	const cmdLine = "cmdline"
+	m := New("", cmdLine, "", nil)
+	m.mem.Phys = testMemory
+	m.header.Flags = flagHeaderMemoryInfo
+
+	info, gotCmdLine, gotBootloader, err := m.PreviewInfo()
+	if err != nil {
+		t.Fatalf("PreviewInfo() error: %v", err)
+	}
+	if gotCmdLine != cmdLine || gotBootloader != bootloader {
+		t.Errorf("PreviewInfo() got strings %q, %q, want %q, %q", gotCmdLine, gotBootloader, cmdLine, bootloader)
+	}
+	if want := flagInfoMemory | flagInfoMemMap | flagInfoCmdLine | flagInfoBootLoaderName; info.Flags != want {
+		t.Errorf("Flags got %#x, want %#x", info.Flags, want)
+	}
+	if len(m.mem.Segments) != 0 || m.info != (Info{}) {
+		t.Errorf("PreviewInfo() staged %d segments and set info %+v, want none", len(m.mem.Segments), m.info)
+	}
+
+	// The next staged info matches the preview.
+	addr, err := m.addInfo()
+	if err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info != info {
+		t.Errorf("addInfo() got info %+v, want preview %+v", m.info, info)
+	}
+	if want := uint32(addr) + sizeofInfo; info.CmdLine != want {
+		t.Errorf("CmdLine got %#x, want %#x", info.CmdLine, want)
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	for _, test := range []struct {
+		info Info
+		want string
+	}{
+		{
+			info: Info{},
+			want: "flags 0x0",
+		},
+		{
+			info: Info{
+				Flags:     flagInfoMemory | flagInfoCmdLine | flagInfoMods | 1<<20,
+				MemLower:  639,
+				MemUpper:  130048,
+				CmdLine:   0x10074,
+				ModsCount: 2,
+				ModsAddr:  0x11000,
+			},
+			want: "flags MEMORY|CMDLINE|MODS|0x100000, mem lower 639KB upper 130048KB, cmdline 0x10074, 2 mods at 0x11000",
+		},
+	} {
+		if got := test.info.String(); got != test.want {
+			t.Errorf("String() got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestWithInfoLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const cmdLine = "cmdline"
+	m := New("", cmdLine, "", createModules(t, dir, 10),
+		WithInfoLayout(InfoMemoryMap, InfoBootLoaderName, InfoModules),
+		WithMemoryMap(testMemory),
+		WithByteOrder(binary.LittleEndian))
+	m.header.Flags = flagHeaderMemoryInfo
+	addr, err := m.addInfo()
+	if err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	// The memory map directly follows the info, then the 4-byte
+	// aligned bootloader name, the module list and the command line.
+	base := uint32(addr)
+	mmapAddr := base + sizeofInfo
+	bootloaderAddr := mmapAddr + m.info.MmapLength
+	modsAddr := (bootloaderAddr + uint32(len(bootloader)) + 1 + 3) &^ 3
+	cmdLineAddr := modsAddr + uint32(sizeofModule)
+	for _, test := range []struct {
+		name      string
+		got, want uint32
+	}{
+		{"MmapAddr", m.info.MmapAddr, mmapAddr},
+		{"BootLoaderName", m.info.BootLoaderName, bootloaderAddr},
+		{"ModsAddr", m.info.ModsAddr, modsAddr},
+		{"CmdLine", m.info.CmdLine, cmdLineAddr},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s got %#x, want %#x", test.name, test.got, test.want)
+		}
+	}
+
+	mmap, err := m.memoryMap().marshal(binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(mmapAddr), len(mmap)); !bytes.Equal(got, mmap) {
+		t.Errorf("memory map got % x, want % x", got, mmap)
+	}
+	mods, err := modules(m.loadedModules).marshal(binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(modsAddr), len(mods)); !bytes.Equal(got, mods) {
+		t.Errorf("module list got % x, want % x", got, mods)
+	}
+	if got := string(segmentData(t, m.mem.Segments, uintptr(cmdLineAddr), len(cmdLine)+1)); got != cmdLine+"\x00" {
+		t.Errorf("command line got %q, want %q", got, cmdLine+"\x00")
+	}
+
+	m = New("", cmdLine, "", nil, WithInfoLayout(InfoCmdLine, InfoCmdLine), WithMemoryMap(testMemory))
+	if _, err := m.addInfo(); err == nil {
+		t.Errorf("addInfo() with duplicate info component got nil error, want error")
+	}
+}
+
+func TestWithMemoryMapFirst(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "default", opts: []Option{WithMemoryMapFirst()}},
+		{name: "with layout", opts: []Option{WithMemoryMapFirst(), WithInfoLayout(InfoBootLoaderName, InfoMemoryMap)}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append([]Option{WithMemoryMap(testMemory)}, test.opts...)
+			m := New("", "cmdline", "", nil, opts...)
+			m.header.Flags = flagHeaderMemoryInfo
+			addr, err := m.addInfo()
+			if err != nil {
+				t.Fatalf("addInfo() error: %v", err)
+			}
+			if want := uint32(addr) + sizeofInfo; m.info.MmapAddr != want {
+				t.Errorf("MmapAddr got %#x, want %#x", m.info.MmapAddr, want)
+			}
+			mmap, err := m.memoryMap().marshal(m.byteOrder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := segmentData(t, m.mem.Segments, uintptr(m.info.MmapAddr), len(mmap)); !bytes.Equal(got, mmap) {
+				t.Errorf("memory map got % x, want % x", got, mmap)
+			}
+		})
+	}
+
+	m := New("", "cmdline", "", nil, WithMemoryMapFirst(), WithInfoChecksum(), WithMemoryMap(testMemory))
+	if _, err := m.addInfo(); err == nil {
+		t.Errorf("addInfo() with info checksum got nil error, want error")
+	}
+}
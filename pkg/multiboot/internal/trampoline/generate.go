@@ -0,0 +1,106 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trampoline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Offsets in the generated trampoline.
+const (
+	genFarPtr = 18
+	genBoot32 = 24
+	genGDT    = 88
+	genGDTPtr = 120
+
+	// GeneratedSize is the size of the generated trampoline.
+	GeneratedSize = 130
+)
+
+// DefaultMagic is the multiboot v1 magic value
+// the kernel expects in EAX.
+const DefaultMagic = 0x2BADB002
+
+// Generate returns amd64 machine code, which does the same as
+// the assembly trampoline: it switches from 64-bit long mode to
+// 32-bit protected mode with paging disabled, sets EAX to magic
+// and EBX to infoAddr, and jumps to entryPoint.
+//
+// The code must be loaded at the physical address base below 4GB.
+func Generate(base, infoAddr, entryPoint uintptr, magic uint32) ([]byte, error) {
+	for _, v := range []struct {
+		name string
+		addr uintptr
+	}{
+		{"trampoline", base + GeneratedSize},
+		{"multiboot info", infoAddr},
+		{"kernel entry point", entryPoint},
+	} {
+		if uint64(v.addr) > math.MaxUint32 {
+			return nil, fmt.Errorf("%s address %#x is above 4GB", v.name, v.addr)
+		}
+	}
+
+	w := bytes.Buffer{}
+	b := func(v ...byte) { w.Write(v) }
+	l := func(v uint32) { binary.Write(&w, binary.LittleEndian, v) }
+	s := func(v uint16) { binary.Write(&w, binary.LittleEndian, v) }
+	q := func(v uint64) { binary.Write(&w, binary.LittleEndian, v) }
+
+	// 64-bit mode.
+	b(0x0F, 0x01, 0x15) // lgdt [rip+rel32]
+	l(genGDTPtr - 7)
+	b(0xBB) // mov ebx, imm32
+	l(uint32(infoAddr))
+	b(0xFF, 0x2D) // ljmp *[rip+rel32]
+	l(0)          // the far pointer follows
+
+	// Far pointer to the 32-bit code.
+	l(uint32(base) + genBoot32)
+	s(0x8)
+
+	// 32-bit compatibility mode.
+	b(0x0F, 0x20, 0xC0) // mov eax, cr0
+	b(0x25)             // and eax, imm32
+	l(0x0FFFFFFF)       // disable paging
+	b(0x0F, 0x22, 0xC0) // mov cr0, eax
+	b(0xB9)             // mov ecx, imm32
+	l(0xC0000080)       // MSR_EFER
+	b(0x0F, 0x32)       // rdmsr
+	b(0x25)             // and eax, imm32
+	l(0xFFFFFEFF)       // disable long mode
+	b(0x0F, 0x30)       // wrmsr
+	b(0x31, 0xC0)       // xor eax, eax
+	b(0x0F, 0x22, 0xE0) // mov cr4, eax
+	b(0xB8)             // mov eax, imm32
+	l(0x10)             // GDT data segment
+	b(0x8E, 0xD8)       // mov ds, ax
+	b(0x8E, 0xC0)       // mov es, ax
+	b(0x8E, 0xD0)       // mov ss, ax
+	b(0x8E, 0xE0)       // mov fs, ax
+	b(0x8E, 0xE8)       // mov gs, ax
+	b(0xB8)             // mov eax, imm32
+	l(magic)            // multiboot magic
+	b(0xEA)             // ljmp $0x18, imm32
+	l(uint32(entryPoint))
+	s(0x18)
+
+	w.Write(make([]byte, genGDT-w.Len()))
+	q(0x0)                // 0x0 null entry
+	q(0x00CF9A000000FFFF) // 0x8 code segment
+	q(0x00CF92000000FFFF) // 0x10 data segment
+	q(0x00CF9A000000FFFF) // 0x18 code segment
+
+	s(4*8 - 1)
+	q(uint64(base) + genGDT)
+
+	if w.Len() != GeneratedSize {
+		return nil, fmt.Errorf("generated trampoline is %d bytes, want %d", w.Len(), GeneratedSize)
+	}
+	return w.Bytes(), nil
+}
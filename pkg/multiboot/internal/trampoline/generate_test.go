@@ -0,0 +1,57 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trampoline
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	const (
+		base  = 0x10000
+		info  = 0x20000
+		entry = 0x100040
+	)
+	d, err := Generate(base, info, entry, 0x1BADB00B)
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+	if len(d) != GeneratedSize {
+		t.Fatalf("Generate() got %d bytes, want %d", len(d), GeneratedSize)
+	}
+
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(d[off:]) }
+	for _, test := range []struct {
+		name string
+		got  uint64
+		want uint64
+	}{
+		{"lgdt target", uint64(7 + int32(u32(3))), genGDTPtr},
+		{"info address", uint64(u32(8)), info},
+		{"far pointer target", uint64(18 + int32(u32(14))), genFarPtr},
+		{"32-bit code address", uint64(u32(genFarPtr)), base + genBoot32},
+		{"32-bit code segment", uint64(binary.LittleEndian.Uint16(d[genFarPtr+4:])), 0x8},
+		{"multiboot magic", uint64(u32(genBoot32 + 46)), 0x1BADB00B},
+		{"entry point", uint64(u32(genBoot32 + 51)), entry},
+		{"kernel code segment", uint64(binary.LittleEndian.Uint16(d[genBoot32+55:])), 0x18},
+		{"GDT limit", uint64(binary.LittleEndian.Uint16(d[genGDTPtr:])), 31},
+		{"GDT address", binary.LittleEndian.Uint64(d[genGDTPtr+2:]), base + genGDT},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s got %#x, want %#x", test.name, test.got, test.want)
+		}
+	}
+
+	// There are no addresses above 4GB on 32-bit platforms.
+	if ^uint(0) != math.MaxUint32 {
+		high := uintptr(math.MaxUint32)
+		high++
+		if _, err := Generate(base, high, entry, DefaultMagic); err == nil {
+			t.Errorf("Generate() with info above 4GB got nil error, want error")
+		}
+	}
+}
@@ -6,8 +6,15 @@
 
 package trampoline
 
-import "errors"
+import (
+	"debug/elf"
+	"errors"
+)
 
-func Setup(path string, infoAddr, entryPoint uintptr) ([]byte, error) {
+func Setup(path string, infoAddr, entryPoint uintptr, magic uint32) ([]byte, error) {
+	return nil, errors.New("not implemented yet")
+}
+
+func SetupEmbedded(machine elf.Machine, infoAddr, entryPoint uintptr, magic uint32) ([]byte, error) {
 	return nil, errors.New("not implemented yet")
 }
@@ -9,9 +9,11 @@ package trampoline
 
 import (
 	"bytes"
+	"debug/elf"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 
 	"github.com/u-root/u-root/pkg/ubinary"
 )
@@ -23,6 +25,7 @@ const (
 
 	trampolineEntry = "u-root-entry-long"
 	trampolineInfo  = "u-root-info-long"
+	trampolineMagic = "u-root-magic-long"
 )
 
 var trampolineBegin []byte
@@ -51,14 +54,48 @@ func alignUp(x int) int {
 	return (x + mask) & ^mask
 }
 
-// Setup scans file for trampoline code and sets
-// values for multiboot info address and kernel entry point.
-func Setup(path string, infoAddr, entryPoint uintptr) ([]byte, error) {
+// Setup scans file for trampoline code and sets values for
+// multiboot info address, kernel entry point and multiboot magic.
+func Setup(path string, infoAddr, entryPoint uintptr, magic uint32) ([]byte, error) {
 	d, err := extract(path)
 	if err != nil {
 		return nil, err
 	}
-	return patch(d, infoAddr, entryPoint)
+	return patch(d, infoAddr, entryPoint, magic)
+}
+
+// embedded maps the machine of a kernel to a function returning
+// the trampoline, which boots it and is linked into the running binary.
+//
+// The amd64 trampoline boots both 32-bit and 64-bit kernels,
+// as multiboot kernels are entered in 32-bit protected mode.
+var embedded = map[elf.Machine]func() ([]byte, error){
+	elf.EM_386:    self,
+	elf.EM_X86_64: self,
+}
+
+// self extracts the trampoline linked into the running binary.
+func self() ([]byte, error) {
+	p, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("cannot find running binary: %v", err)
+	}
+	return extract(p)
+}
+
+// SetupEmbedded selects the embedded trampoline booting kernels
+// built for machine and sets values for multiboot info address,
+// kernel entry point and multiboot magic.
+func SetupEmbedded(machine elf.Machine, infoAddr, entryPoint uintptr, magic uint32) ([]byte, error) {
+	f, ok := embedded[machine]
+	if !ok {
+		return nil, fmt.Errorf("no embedded trampoline for %v kernels", machine)
+	}
+	d, err := f()
+	if err != nil {
+		return nil, err
+	}
+	return patch(d, infoAddr, entryPoint, magic)
 }
 
 // extract extracts trampoline segment from file.
@@ -89,20 +126,33 @@ func extract(path string) ([]byte, error) {
 }
 
 // patch patches the trampoline code to store value for multiboot info address
-// after "u-root-header-long" byte sequence + padding and value
-// for kernel entry point, after "u-root-entry-long" byte sequence + padding.
-func patch(trampoline []byte, infoAddr, entryPoint uintptr) ([]byte, error) {
+// after "u-root-header-long" byte sequence + padding, value
+// for kernel entry point, after "u-root-entry-long" byte sequence + padding
+// and value for multiboot magic, after "u-root-magic-long" byte sequence + padding.
+//
+// Trampolines built before the magic became patchable have no magic label,
+// they can only be used with DefaultMagic.
+func patch(trampoline []byte, infoAddr, entryPoint uintptr, magic uint32) ([]byte, error) {
 	replace := func(d, label []byte, val uint32) error {
 		buf := make([]byte, 4)
 		ubinary.NativeEndian.PutUint32(buf, val)
 
+		// A label found more than once would silently
+		// leave the real patch site unpatched.
+		if n := bytes.Count(d, label); n > 1 {
+			return fmt.Errorf("label %q found %d times, expected exactly 1", label, n)
+		}
 		ind := bytes.Index(d, label)
 		if ind == -1 {
 			return fmt.Errorf("%q label not found in file", label)
 		}
 		ind = alignUp(ind + len(label))
 		if len(d) < ind+len(buf) {
-			return io.ErrUnexpectedEOF
+			avail := len(d) - ind
+			if avail < 0 {
+				avail = 0
+			}
+			return fmt.Errorf("not enough space after %q label: %d bytes available, %d bytes needed", label, avail, len(buf))
 		}
 		copy(d[ind:], buf)
 		return nil
@@ -114,5 +164,11 @@ func patch(trampoline []byte, infoAddr, entryPoint uintptr) ([]byte, error) {
 	if err := replace(trampoline, []byte(trampolineEntry), uint32(entryPoint)); err != nil {
 		return nil, err
 	}
+	if magic == DefaultMagic && !bytes.Contains(trampoline, []byte(trampolineMagic)) {
+		return trampoline, nil
+	}
+	if err := replace(trampoline, []byte(trampolineMagic), magic); err != nil {
+		return nil, err
+	}
 	return trampoline, nil
 }
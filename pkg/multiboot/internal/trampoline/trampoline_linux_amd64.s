@@ -39,6 +39,11 @@ TEXT ·start(SB),NOSPLIT,$0
 	// Don't modify BX.
 	MOVL	info(SB), BX
 
+	// Store value of multiboot magic in SI,
+	// it is moved to AX in 32-bit mode.
+	// Don't modify SI.
+	MOVL	magic(SB), SI
+
 	// Far return doesn't work on QEMU in 64-bit mode,
 	// let's do far jump.
 	//
@@ -92,7 +97,7 @@ TEXT boot(SB),NOSPLIT,$0
 	BYTE	$0x8e; BYTE $0xe0 // MOVL AX, FS
 	BYTE	$0x8e; BYTE $0xe8 // MOVL AX, GS
 
-	MOVL	$MAGIC, AX
+	MOVL	SI, AX
 	JMP	farjump32(SB)
 
 	// Unreachable code.
@@ -101,6 +106,7 @@ TEXT boot(SB),NOSPLIT,$0
 	JMP	begin(SB)
 	JMP	infotext(SB)
 	JMP	entrytext(SB)
+	JMP	magictext(SB)
 	JMP	end(SB)
 
 TEXT farjump64(SB),NOSPLIT,$0
@@ -139,6 +145,15 @@ TEXT entrytext(SB),NOSPLIT,$0
 TEXT entry(SB),NOSPLIT,$0
 	LONG	$0x0
 
+TEXT magictext(SB),NOSPLIT,$0
+	// u-root-magic-long
+	BYTE $'u'; BYTE $'-'; BYTE $'r'; BYTE $'o'; BYTE $'o';
+	BYTE $'t'; BYTE $'-'; BYTE $'m'; BYTE $'a'; BYTE $'g';
+	BYTE $'i'; BYTE $'c'; BYTE $'-'; BYTE $'l'; BYTE $'o';
+	BYTE $'n'; BYTE $'g';
+TEXT magic(SB),NOSPLIT,$0
+	LONG	$MAGIC
+
 TEXT end(SB),NOSPLIT,$0
 	// u-root-trampoline-end
 	BYTE $'u'; BYTE $'-'; BYTE $'r'; BYTE $'o'; BYTE $'o';
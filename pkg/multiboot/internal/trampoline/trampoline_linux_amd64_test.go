@@ -0,0 +1,109 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trampoline
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/ubinary"
+)
+
+func TestPatchNoSpace(t *testing.T) {
+	// The info label is patched first, so the entry label
+	// is the one without enough space after it.
+	d := []byte(trampolineInfo)
+	d = append(d, make([]byte, alignUp(len(d))-len(d)+4)...)
+	d = append(d, []byte(trampolineEntry)...)
+	d = append(d, make([]byte, alignUp(len(d))-len(d)+2)...)
+
+	_, err := patch(d, 0x1000, 0x2000, DefaultMagic)
+	if err == nil {
+		t.Fatalf("patch() got nil error, want error")
+	}
+	for _, s := range []string{trampolineEntry, "2 bytes available", "4 bytes needed"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("patch() error %q does not contain %q", err, s)
+		}
+	}
+}
+
+func TestSetupEmbedded(t *testing.T) {
+	p, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Setup(p, 0x1000, 0x2000, DefaultMagic)
+	if err != nil {
+		t.Fatalf("Setup() error: %v", err)
+	}
+
+	for _, machine := range []elf.Machine{elf.EM_386, elf.EM_X86_64} {
+		got, err := SetupEmbedded(machine, 0x1000, 0x2000, DefaultMagic)
+		if err != nil {
+			t.Errorf("SetupEmbedded(%v) error: %v", machine, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("SetupEmbedded(%v) did not return the amd64 trampoline", machine)
+		}
+	}
+
+	if _, err := SetupEmbedded(elf.EM_ARM, 0x1000, 0x2000, DefaultMagic); err == nil {
+		t.Errorf("SetupEmbedded(%v) got nil error, want error", elf.EM_ARM)
+	}
+}
+
+func TestPatchDuplicateLabel(t *testing.T) {
+	var d []byte
+	for i := 0; i < 2; i++ {
+		d = append(d, []byte(trampolineInfo)...)
+		d = append(d, make([]byte, alignUp(len(d))-len(d)+4)...)
+	}
+	d = append(d, []byte(trampolineEntry)...)
+	d = append(d, make([]byte, alignUp(len(d))-len(d)+4)...)
+
+	_, err := patch(d, 0x1000, 0x2000, DefaultMagic)
+	if err == nil {
+		t.Fatalf("patch() got nil error, want error")
+	}
+	for _, s := range []string{trampolineInfo, "found 2 times"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("patch() error %q does not contain %q", err, s)
+		}
+	}
+}
+
+func TestPatchMagic(t *testing.T) {
+	const magic = 0x1BADB00B
+	p, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Setup(p, 0x1000, 0x2000, magic)
+	if err != nil {
+		t.Fatalf("Setup() error: %v", err)
+	}
+	ind := alignUp(bytes.Index(d, []byte(trampolineMagic)) + len(trampolineMagic))
+	if got := ubinary.NativeEndian.Uint32(d[ind:]); got != magic {
+		t.Errorf("magic got %#x, want %#x", got, magic)
+	}
+
+	// A trampoline without the magic label only supports the default magic.
+	var old []byte
+	for _, label := range []string{trampolineInfo, trampolineEntry} {
+		old = append(old, []byte(label)...)
+		old = append(old, make([]byte, alignUp(len(old))-len(old)+4)...)
+	}
+	if _, err := patch(old, 0x1000, 0x2000, DefaultMagic); err != nil {
+		t.Errorf("patch() without magic label error: %v", err)
+	}
+	if _, err := patch(old, 0x1000, 0x2000, magic); err == nil {
+		t.Errorf("patch() without magic label got nil error for magic %#x, want error", magic)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Stages of Load, reported by LoadError.
+var (
+	ErrReadKernel     = errors.New("error reading kernel")
+	ErrParseHeader    = errors.New("error parsing headers")
+	ErrLoadSegments   = errors.New("error loading kernel segments")
+	ErrEntryPoint     = errors.New("error getting kernel entry point")
+	ErrSectionHeaders = errors.New("error reading ELF section headers")
+	ErrMemoryMap      = errors.New("error parsing memory map")
+	ErrInfo           = errors.New("error preparing multiboot info")
+	ErrTrampoline     = errors.New("error adding trampoline")
+	ErrValidate       = errors.New("error validating segments")
+)
+
+// LoadError is returned by Load if a stage of loading fails.
+//
+// Callers can check the stage and the cause, e.g. to try another
+// loader if the kernel has no multiboot header:
+//	if le, ok := err.(*LoadError); ok && le.Stage == ErrParseHeader && le.Err == ErrHeaderNotFound {
+//		...
+//	}
+// With Go 1.13 errors.Is(err, ErrParseHeader) and
+// errors.Is(err, ErrHeaderNotFound) work as well.
+type LoadError struct {
+	// Stage is one of the stage errors, e.g. ErrParseHeader.
+	Stage error
+	// Op describes the failed operation within the stage,
+	// e.g. "error loading ELF segments". If empty, the stage
+	// describes it.
+	Op string
+	// Err is the cause of the failure.
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	if e.Op != "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the cause of the failure.
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the stage of e.
+func (e *LoadError) Is(target error) bool {
+	return target == e.Stage
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	arm := append([]byte{}, kernel...)
+	binary.LittleEndian.PutUint16(arm[18:], 40) // EM_ARM
+
+	for _, test := range []struct {
+		name   string
+		kernel []byte
+		stage  error
+		cause  error
+	}{
+		{name: "no header", kernel: make([]byte, 0x2000), stage: ErrParseHeader, cause: ErrHeaderNotFound},
+		{name: "arm", kernel: arm, stage: ErrEntryPoint},
+		{name: "multiboot2", kernel: createHeader2(t, 0, 0x2000, endTag2), stage: ErrParseHeader, cause: ErrMultiboot2NotSupported},
+		// The kernel file does not exist.
+		{name: "missing", stage: ErrReadKernel},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(dir, test.name)
+			if test.kernel != nil {
+				if err := ioutil.WriteFile(name, test.kernel, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m := New(name, "", "", nil, WithMemoryMap(testMemory))
+			err := m.Load(false)
+			le, ok := err.(*LoadError)
+			if !ok {
+				t.Fatalf("Load() got error %v, want *LoadError", err)
+			}
+			if le.Stage != test.stage {
+				t.Errorf("Load() got stage %v, want %v", le.Stage, test.stage)
+			}
+			if test.cause != nil && le.Err != test.cause {
+				t.Errorf("Load() got cause %v, want %v", le.Err, test.cause)
+			}
+			if !le.Is(test.stage) || le.Unwrap() != le.Err {
+				t.Errorf("LoadError does not match its stage %v and cause %v", test.stage, le.Err)
+			}
+		})
+	}
+}
+
+func TestLoadErrorOp(t *testing.T) {
+	cause := errors.New("cause")
+	for _, test := range []struct {
+		err  *LoadError
+		want string
+	}{
+		{err: &LoadError{Stage: ErrInfo, Err: cause}, want: "error preparing multiboot info: cause"},
+		{err: &LoadError{Stage: ErrLoadSegments, Op: "error reserving kernel memory", Err: cause}, want: "error reserving kernel memory: cause"},
+	} {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("Error() got %q, want %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logger logs the progress of loading a multiboot kernel.
+//
+// *log.Logger implements Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger logs to the standard logger of the log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+}
@@ -9,13 +9,19 @@ package multiboot
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/u-root/u-root/pkg/ubinary"
+	"github.com/u-root/u-root/pkg/kexec"
 )
 
 // A Module represents a module to be loaded along with the kernel.
@@ -34,115 +40,562 @@ type Module struct {
 
 type modules []Module
 
+// ModuleSpec describes a module to be loaded along with the kernel.
+type ModuleSpec struct {
+	// Path is the path of the module file.
+	Path string
+	// CmdLine is the module command line passed to the kernel verbatim.
+	// By convention it starts with the module name.
+	CmdLine string
+
+	// Reader, if not nil, provides the module content instead of
+	// the file at Path, which is then only used as the module name.
+	Reader io.ReaderAt
+	// Size is the size of the content provided by Reader.
+	Size int64
+}
+
+// open returns a reader of the module content and a function,
+// which closes it.
+func (mod ModuleSpec) open() (io.ReadSeeker, func() error, error) {
+	if mod.Reader != nil {
+		return io.NewSectionReader(mod.Reader, 0, mod.Size), func() error { return nil }, nil
+	}
+	f, err := os.Open(mod.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// moduleSpecs converts space separated module command lines,
+// where the first field is the module path, to module specs.
+func moduleSpecs(cmds []string) []ModuleSpec {
+	var specs []ModuleSpec
+	for _, cmd := range cmds {
+		var path string
+		if f := strings.Fields(cmd); len(f) > 0 {
+			path = f[0]
+		}
+		specs = append(specs, ModuleSpec{Path: path, CmdLine: cmd})
+	}
+	return specs
+}
+
+// ValidateModules checks the module list for mistakes, which would
+// make the load use much more memory than intended: a module, which is
+// the kernel file itself, or a module file listed more than
+// maxDuplicates times. maxDuplicates <= 0 allows any number of
+// duplicates.
+//
+// Modules provided by a Reader are not checked.
+func (m *Multiboot) ValidateModules(maxDuplicates int) error {
+	var kernel os.FileInfo
+	if f, ok := m.kernel.(*os.File); ok {
+		kernel, _ = f.Stat()
+	} else if m.kernel == nil && m.file != "" {
+		kernel, _ = os.Stat(m.file)
+	}
+
+	count := make(map[string]int)
+	for _, mod := range m.modules {
+		if mod.Reader != nil || mod.Path == "" {
+			continue
+		}
+		if kernel != nil {
+			if fi, err := os.Stat(mod.Path); err == nil && os.SameFile(fi, kernel) {
+				return fmt.Errorf("module %v is the kernel file", mod.Path)
+			}
+		}
+		path, err := filepath.Abs(mod.Path)
+		if err != nil {
+			path = filepath.Clean(mod.Path)
+		}
+		count[path]++
+		if maxDuplicates > 0 && count[path] > maxDuplicates {
+			return fmt.Errorf("module %v is listed more than %d times", mod.Path, maxDuplicates)
+		}
+	}
+	return nil
+}
+
 func (m *Multiboot) addModules() (uintptr, error) {
-	loaded, data, err := loadModules(m.modules)
+	b, err := m.prepareModules()
 	if err != nil {
 		return 0, err
 	}
+	return m.mem.AddKexecSegmentIn(b, below4G)
+}
+
+// prepareModules stages the modules and their command lines,
+// and returns the marshaled module list.
+func (m *Multiboot) prepareModules() ([]byte, error) {
+	if m.validateModules {
+		if err := m.ValidateModules(m.maxDuplicateModules); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.maxModuleCmdLine > 0 {
+		for _, mod := range m.modules {
+			if len(mod.CmdLine) > m.maxModuleCmdLine {
+				return nil, fmt.Errorf("command line of module %v is %d bytes long, exceeds limit of %d bytes",
+					mod.Path, len(mod.CmdLine), m.maxModuleCmdLine)
+			}
+		}
+	}
+
+	if m.asciiCmdLines {
+		for _, mod := range m.modules {
+			if err := checkASCII(mod.CmdLine); err != nil {
+				return nil, fmt.Errorf("invalid command line %q of module %v: %v", mod.CmdLine, mod.Path, err)
+			}
+		}
+	}
 
-	addr, err := m.mem.AddKexecSegment(data)
+	if m.moduleAlign&(m.moduleAlign-1) != 0 {
+		return nil, fmt.Errorf("module alignment %#x is not a power of two", m.moduleAlign)
+	}
+
+	loaded, data, reports, err := loadModules(m.logger, m.modules, m.moduleNorm, m.maxModuleSize)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	m.moduleReports = reports
 
-	loaded.fix(uint32(addr))
+	if err := m.placeModules(loaded, data); err != nil {
+		return nil, err
+	}
+	if err := loaded.verify(m.mem.Segments); err != nil {
+		return nil, err
+	}
 
-	m.loadedModules = loaded
+	// Module references are resolved once all modules are placed.
+	cmds, err := resolveModuleRefs(m.modules, loaded)
+	if err != nil {
+		return nil, err
+	}
+	cmdLines, err := loaded.setCmdLines(cmds)
+	if err != nil {
+		return nil, err
+	}
 
-	b, err := loaded.marshal()
+	addr, err := m.mem.AddKexecSegmentIn(cmdLines, below4G)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	base, err := addr32("module command lines", addr, uint(len(cmdLines)))
+	if err != nil {
+		return nil, err
 	}
-	return m.mem.AddKexecSegment(b)
+	loaded.fix(base)
+
+	m.loadedModules = loaded
+	m.moduleCmdLines = cmds
+
+	return loaded.marshal(m.byteOrder)
 }
 
-// loadModules loads module files.
-// Returns loaded modules description and buffer storing loaded modules.
-// Memory layout of the loaded modules is following:
-//			cmdLine_1
-//			cmdLine_2
-//			...
-//			cmdLine_n
-//			<padding>
-//			modules_1
-//			<padding>
-//			modules_2
-//			...
-//			<padding>
-//			modules_n
+// modulePageSize is the page size modules are aligned to
+// if the kernel sets flagHeaderPageAlign.
+const modulePageSize = 4096
+
+// placeModules stages each module in its own kexec segment below 4GB.
+// Modules are aligned at least to a page boundary and
+// placed above the module floor and the kernel, if requested.
 //
-// <padding> aligns the start of each module to a page beginning.
-func loadModules(cmds []string) (loaded modules, data []byte, err error) {
-	loaded = make(modules, len(cmds))
-	buf := bytes.Buffer{}
+// Modules are placed largest-first, so that the biggest modules get the
+// biggest free regions before smaller modules fragment them.
+func (m *Multiboot) placeModules(loaded modules, data [][]byte) error {
+	order := make([]int, len(data))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(data[order[i]]) > len(data[order[j]])
+	})
 
-	for i, cmd := range cmds {
-		if err := loaded[i].setCmdLine(&buf, cmd); err != nil {
-			return nil, nil, err
+	limit := below4G
+	floor := m.moduleFloor
+	if m.modulesAboveKernel && m.kernelEnd > floor {
+		floor = m.kernelEnd
+	}
+	if floor > 0 {
+		if floor >= below4G.Start+uintptr(below4G.Size) {
+			return fmt.Errorf("module floor %#x is above 4GB", floor)
 		}
+		limit = kexec.Range{Start: floor, Size: below4G.Size - uint(floor-below4G.Start)}
 	}
 
-	for i, cmd := range cmds {
-		name := strings.Fields(cmd)[0]
-		if err := loaded[i].loadModule(&buf, name); err != nil {
-			return nil, nil, fmt.Errorf("error adding module %v: %v", name, err)
+	// kexec segments are aligned to the host page size, which
+	// is not necessarily the 4KB pages requested by the kernel.
+	align := m.moduleAlign
+	if m.header.Flags&flagHeaderPageAlign != 0 && align < modulePageSize {
+		align = modulePageSize
+	}
+
+	// placed maps the content hash of placed modules to their index.
+	placed := make(map[[sha256.Size]byte]int)
+	for _, i := range order {
+		if len(data[i]) == 0 {
+			continue
 		}
+		if m.dedupModules {
+			hash := sha256.Sum256(data[i])
+			if j, ok := placed[hash]; ok {
+				loaded[i].Start, loaded[i].End = loaded[j].Start, loaded[j].End
+				continue
+			}
+			placed[hash] = i
+		}
+		addr, err := m.mem.AddKexecSegmentAligned(data[i], limit, align)
+		if err != nil {
+			return fmt.Errorf("error placing module %v: %v", m.modules[i].Path, err)
+		}
+		start, err := addr32(fmt.Sprintf("module %v", m.modules[i].Path), addr, uint(len(data[i])))
+		if err != nil {
+			return err
+		}
+		loaded[i].Start = start
+		loaded[i].End = start + uint32(len(data[i]))
 	}
+	return nil
+}
 
-	return loaded, buf.Bytes(), nil
+// verify checks that the ranges of non-empty modules do not
+// overlap and lie within the kexec segments segs.
+// Modules with the same range share their content.
+func (m modules) verify(segs []kexec.Segment) error {
+	for i, mod := range m {
+		if mod.Start == mod.End {
+			continue
+		}
+		if mod.End < mod.Start {
+			return fmt.Errorf("module %d: end %#x is below start %#x", i, mod.End, mod.Start)
+		}
+		r := kexec.Range{Start: uintptr(mod.Start), Size: uint(mod.End - mod.Start)}
+		for j, mod2 := range m[:i] {
+			if mod2.Start == mod2.End || (mod2.Start == mod.Start && mod2.End == mod.End) {
+				continue
+			}
+			if r.Overlaps(kexec.Range{Start: uintptr(mod2.Start), Size: uint(mod2.End - mod2.Start)}) {
+				return fmt.Errorf("module %d [%#x, %#x) overlaps module %d [%#x, %#x)", i, mod.Start, mod.End, j, mod2.Start, mod2.End)
+			}
+		}
+		var found bool
+		for _, s := range segs {
+			if s.Phys.IsSupersetOf(r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("module %d [%#x, %#x) is not within a segment", i, mod.Start, mod.End)
+		}
+	}
+	return nil
 }
 
-// alignUp pads buf to a page boundary.
-func alignUp(buf *bytes.Buffer) error {
-	mask := (os.Getpagesize() - 1)
-	size := (buf.Len() + mask) &^ mask
-	_, err := buf.Write(bytes.Repeat([]byte{0}, size-buf.Len()))
-	return err
+// ModuleNormalization defines how modules are
+// transformed before they are staged.
+type ModuleNormalization int
+
+const (
+	// AlwaysDecompress stages modules decompressed.
+	AlwaysDecompress ModuleNormalization = iota
+	// Passthrough stages modules exactly as they are stored.
+	Passthrough
+	// AlwaysGzip stages modules gzip compressed.
+	AlwaysGzip
+)
+
+// ModuleReport describes how a module was read and staged.
+type ModuleReport struct {
+	Path string
+	// Format is the compression format of the stored module, e.g.
+	// FormatGzip. With Passthrough it is guessed from the magic number.
+	Format string
+	// StoredSize is the size of the module as stored.
+	StoredSize int64
+	// DecompressedSize is the size of the module content after
+	// decompression. It is zero with Passthrough for compressed modules,
+	// which are not decompressed.
+	DecompressedSize int64
+	// StagedSize is the size of the module passed to the kernel.
+	StagedSize int64
 }
 
-func (m *Module) loadModule(buf *bytes.Buffer, name string) error {
-	log.Printf("Adding module %v", name)
+// readModule reads a module normalizing its content according to norm.
+// max <= 0 means no limit of the module size.
+func readModule(mod ModuleSpec, norm ModuleNormalization, max int64) ([]byte, error) {
+	b, _, err := readModuleReport(mod, norm, max)
+	return b, err
+}
 
-	b, err := readFile(name)
+// readModuleReport is like readModule, but also reports
+// how the module was read.
+func readModuleReport(mod ModuleSpec, norm ModuleNormalization, max int64) ([]byte, ModuleReport, error) {
+	report := ModuleReport{Path: mod.Path}
+	r, closer, err := mod.open()
 	if err != nil {
-		return err
+		return nil, report, err
+	}
+	defer closer()
+	if report.StoredSize, err = r.Seek(0, io.SeekEnd); err != nil {
+		return nil, report, err
 	}
 
-	// place start of each module to a beginning of a page.
-	if err := alignUp(buf); err != nil {
-		return err
+	var b []byte
+	switch norm {
+	case AlwaysDecompress, AlwaysGzip:
+		if b, report.Format, err = decompress(r, max); err != nil {
+			return nil, report, err
+		}
+		report.DecompressedSize = int64(len(b))
+	case Passthrough:
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, report, err
+		}
+		if b, err = readAllLimit(r, max); err != nil {
+			return nil, report, err
+		}
+		if report.Format = detectFormat(b); report.Format == FormatRaw {
+			report.DecompressedSize = int64(len(b))
+		}
+	default:
+		return nil, report, fmt.Errorf("unknown module normalization %d", norm)
 	}
 
-	m.Start = uint32(buf.Len())
-	if _, err := buf.Write(b); err != nil {
-		return err
+	if norm == AlwaysGzip {
+		// Leave the gzip header empty to get
+		// the same output for the same module.
+		buf := bytes.Buffer{}
+		z := gzip.NewWriter(&buf)
+		if _, err := z.Write(b); err != nil {
+			return nil, report, err
+		}
+		if err := z.Close(); err != nil {
+			return nil, report, err
+		}
+		b = buf.Bytes()
 	}
-	m.End = uint32(buf.Len())
+	report.StagedSize = int64(len(b))
+	return b, report, nil
+}
 
-	return nil
+// loadModules loads module files.
+// Returns loaded modules description, the content
+// and the report of each module.
+func loadModules(logger Logger, mods []ModuleSpec, norm ModuleNormalization, max int64) (loaded modules, data [][]byte, reports []ModuleReport, err error) {
+	loaded = make(modules, len(mods))
+	for _, mod := range mods {
+		logger.Printf("Adding module %v", mod.Path)
+		if mod.Path == "" && mod.Reader == nil {
+			return nil, nil, nil, fmt.Errorf("module path is empty")
+		}
+		b, report, err := readModuleReport(mod, norm, max)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error adding module %v: %v", mod.Path, err)
+		}
+		data = append(data, b)
+		reports = append(reports, report)
+	}
+	return loaded, data, reports, nil
+}
+
+// ModuleReports returns how each module was read and staged
+// by the last Load, in the order of the modules.
+func (m *Multiboot) ModuleReports() []ModuleReport {
+	return m.moduleReports
+}
+
+// ModuleInfo describes where a module was placed by Load.
+type ModuleInfo struct {
+	// Path is the path of the module file.
+	Path string
+	// Start is the inclusive start of the module in physical memory.
+	Start uint32
+	// End is the exclusive end of the module in physical memory.
+	End uint32
+	// CmdLine is the module command line passed to the kernel,
+	// with module references resolved.
+	CmdLine string
+}
+
+// Modules returns where each module was placed by the last Load,
+// in the order of the modules.
+func (m *Multiboot) Modules() []ModuleInfo {
+	var infos []ModuleInfo
+	for i, mod := range m.loadedModules {
+		infos = append(infos, ModuleInfo{
+			Path:    m.modules[i].Path,
+			Start:   mod.Start,
+			End:     mod.End,
+			CmdLine: m.moduleCmdLines[i],
+		})
+	}
+	return infos
+}
+
+// moduleRef matches references to other modules in module command lines.
+var moduleRef = regexp.MustCompile(`%MOD(ADDR|INDEX):([^%]+)%`)
+
+// moduleIndex returns the index of module name in mods,
+// where name is the path or the file name of a module.
+func moduleIndex(mods []ModuleSpec, name string) (int, bool) {
+	for i, mod := range mods {
+		if mod.Path == name || filepath.Base(mod.Path) == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// resolveRefs substitutes references to modules in the command line cmd:
+//	%MODADDR:name% is replaced by the load address of module name,
+//	%MODINDEX:name% is replaced by the index of module name,
+// where name is the path or the file name of a module.
+// what names the command line in errors.
+func resolveRefs(what, cmd string, mods []ModuleSpec, loaded modules) (string, error) {
+	var err error
+	ret := moduleRef.ReplaceAllStringFunc(cmd, func(ref string) string {
+		sm := moduleRef.FindStringSubmatch(ref)
+		j, ok := moduleIndex(mods, sm[2])
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("%v references unknown module %v", what, sm[2])
+			}
+			return ref
+		}
+		if sm[1] == "ADDR" {
+			return fmt.Sprintf("%#x", loaded[j].Start)
+		}
+		return strconv.Itoa(j)
+	})
+	return ret, err
+}
+
+// resolveModuleRefs substitutes references to other modules
+// in the module command lines cmds, see resolveRefs.
+func resolveModuleRefs(mods []ModuleSpec, loaded modules) ([]string, error) {
+	ret := make([]string, len(mods))
+	for i, mod := range mods {
+		var err error
+		if ret[i], err = resolveRefs(fmt.Sprintf("command line of module %v", mod.Path), mod.CmdLine, mods, loaded); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// resolveCmdLine returns the kernel command line with module
+// references substituted, see resolveRefs, and with each placeholder
+// of m.cmdLinePlaceholders replaced by the load address of its module.
+// The command line is passed verbatim if there are no placeholders.
+// It must be called once the modules are placed.
+func (m *Multiboot) resolveCmdLine() (string, error) {
+	if len(m.cmdLinePlaceholders) == 0 {
+		return m.cmdLine, nil
+	}
+	cmdLine, err := resolveRefs("kernel command line", m.cmdLine, m.modules, m.loadedModules)
+	if err != nil {
+		return "", err
+	}
+	// Replace placeholders in a stable order.
+	placeholders := make([]string, 0, len(m.cmdLinePlaceholders))
+	for p := range m.cmdLinePlaceholders {
+		placeholders = append(placeholders, p)
+	}
+	sort.Strings(placeholders)
+	for _, p := range placeholders {
+		name := m.cmdLinePlaceholders[p]
+		j, ok := moduleIndex(m.modules, name)
+		if !ok || j >= len(m.loadedModules) {
+			return "", fmt.Errorf("command line placeholder %v references unknown module %v", p, name)
+		}
+		cmdLine = strings.Replace(cmdLine, p, fmt.Sprintf("%#x", m.loadedModules[j].Start), -1)
+	}
+	return cmdLine, nil
+}
+
+// setCmdLines sets the command lines of modules and returns
+// a buffer storing the null-terminated command lines.
+// Memory layout of the command lines buffer is following:
+//			cmdLine_1
+//			cmdLine_2
+//			...
+//			cmdLine_n
+func (m modules) setCmdLines(cmds []string) ([]byte, error) {
+	var size int
+	for _, cmd := range cmds {
+		size += len(cmd) + 1
+	}
+	buf := bytes.Buffer{}
+	buf.Grow(size)
+	if err := m.writeCmdLines(&buf, cmds); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func (m *Module) setCmdLine(buf *bytes.Buffer, cmdLine string) error {
-	m.CmdLine = uint32(buf.Len())
-	if _, err := buf.WriteString(cmdLine); err != nil {
-		return err
+// writeCmdLines writes the null-terminated command lines to w and sets
+// the command line pointers of modules relative to the first one.
+func (m modules) writeCmdLines(w io.Writer, cmds []string) error {
+	var off uint32
+	for i, cmd := range cmds {
+		m[i].CmdLine = off
+		if _, err := io.WriteString(w, cmd); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+		off += uint32(len(cmd)) + 1
 	}
-	return buf.WriteByte(0)
+	return nil
 }
 
-// fix fixes pointers converting relative values to absolute values.
+// fix fixes command line pointers converting relative values to absolute values.
 func (m modules) fix(base uint32) {
 	for i := range m {
-		m[i].Start += base
-		m[i].End += base
 		m[i].CmdLine += base
 	}
 }
 
+var sizeofModule = binary.Size(Module{})
+
 // marshal writes out the exact bytes of modules to be loaded
 // along with the kernel.
-func (m modules) marshal() ([]byte, error) {
+//
+// The modules are streamed by writeTo into a buffer of the final
+// size, which is staged as the kexec segment buffer as is, so the
+// table is never copied.
+func (m modules) marshal(order binary.ByteOrder) ([]byte, error) {
 	buf := bytes.Buffer{}
-	err := binary.Write(&buf, ubinary.NativeEndian, m)
-	return buf.Bytes(), err
+	buf.Grow(len(m) * sizeofModule)
+	if err := m.writeTo(&buf, order); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTo writes the modules to w one at a time.
+// The command line pointers must be set by writeCmdLines and fix first.
+func (m modules) writeTo(w io.Writer, order binary.ByteOrder) error {
+	d := make([]byte, sizeofModule)
+	for i, mod := range m {
+		// The spec requires the reserved field to be zero.
+		if mod.Reserved != 0 {
+			return fmt.Errorf("module %d: reserved field is %#x, must be 0", i, mod.Reserved)
+		}
+		order.PutUint32(d[0:], mod.Start)
+		order.PutUint32(d[4:], mod.End)
+		order.PutUint32(d[8:], mod.CmdLine)
+		order.PutUint32(d[12:], mod.Reserved)
+		if _, err := w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,708 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// createModules writes a module file of each size in bytes into dir
+// and returns the module command lines.
+func createModules(t *testing.T, dir string, sizes ...int) []string {
+	var cmds []string
+	for i, sz := range sizes {
+		name := filepath.Join(dir, string('a'+rune(i)))
+		if err := ioutil.WriteFile(name, bytes.Repeat([]byte{byte('a' + i)}, sz), 0644); err != nil {
+			t.Fatalf("Cannot create module: %v", err)
+		}
+		cmds = append(cmds, name+" arg")
+	}
+	return cmds
+}
+
+func TestAddModulesLargestFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	page := os.Getpagesize()
+	// Placing the smaller module first leaves no region big enough
+	// for the second one.
+	m := New("", "", "", createModules(t, dir, 2*page, 3*page))
+	m.mem.Phys = []kexec.TypedAddressRange{
+		{Range: kexec.Range{Start: 0x200000, Size: uint(3 * page)}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x400000, Size: uint(2 * page)}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x600000, Size: uint(2 * page)}, Type: kexec.RangeRAM},
+	}
+
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+
+	for i, want := range []uint32{0x400000, 0x200000} {
+		if got := m.loadedModules[i].Start; got != want {
+			t.Errorf("module %d: got start %#x, want %#x", i, got, want)
+		}
+	}
+}
+
+func TestMaxModuleCmdLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mods := createModules(t, dir, 10, 10)
+	mods[1] += strings.Repeat(" arg", 100)
+	m := New("", "", "", mods, WithMaxModuleCmdLine(256))
+	m.mem.Phys = testMemory
+
+	_, err = m.addModules()
+	if err == nil {
+		t.Fatalf("addModules() got nil error, want error")
+	}
+	if name := strings.Fields(mods[1])[0]; !strings.Contains(err.Error(), name) {
+		t.Errorf("addModules() error %q does not name module %v", err, name)
+	}
+}
+
+func TestModuleAlignment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const align = 2 << 20
+	m := New("", "", "", createModules(t, dir, 10, 10), WithModuleAlignment(align))
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+	for i, mod := range m.loadedModules {
+		if mod.Start%align != 0 {
+			t.Errorf("module %d: start %#x is not aligned to %#x", i, mod.Start, align)
+		}
+	}
+
+	m = New("", "", "", createModules(t, dir, 10), WithModuleAlignment(3<<20))
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err == nil {
+		t.Errorf("addModules() with alignment 3MB got nil error, want error")
+	}
+}
+
+func TestModulePageAlignment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := New("", "", "", createModules(t, dir, 10, 10, 10))
+	m.header.Flags = flagHeaderPageAlign
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+	for i, mod := range m.loadedModules {
+		if mod.Start%modulePageSize != 0 {
+			t.Errorf("module %d: start %#x is not page aligned", i, mod.Start)
+		}
+	}
+}
+
+func TestModuleDeduplication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(name, []byte("module"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mods := []string{name + " first", name + " second"}
+
+	for _, test := range []struct {
+		name     string
+		opts     []Option
+		segments int
+	}{
+		{name: "default", segments: 2},
+		{name: "dedup", opts: []Option{WithModuleDeduplication()}, segments: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := New("", "", "", mods, test.opts...)
+			m.mem.Phys = testMemory
+			if _, err := m.addModules(); err != nil {
+				t.Fatalf("addModules() error: %v", err)
+			}
+
+			var segments int
+			for _, s := range m.mem.Segments {
+				if s.Phys.Start == uintptr(m.loadedModules[0].Start) || s.Phys.Start == uintptr(m.loadedModules[1].Start) {
+					segments++
+				}
+			}
+			if segments != test.segments {
+				t.Errorf("modules are stored in %d segments, want %d", segments, test.segments)
+			}
+			for i, mod := range m.loadedModules {
+				if got := string(segmentData(t, m.mem.Segments, uintptr(mod.Start), int(mod.End-mod.Start))); got != "module" {
+					t.Errorf("module %d content got %q, want %q", i, got, "module")
+				}
+				if got := segmentData(t, m.mem.Segments, uintptr(mod.CmdLine), len(mods[i])+1); string(got) != mods[i]+"\x00" {
+					t.Errorf("module %d command line got %q, want %q", i, got, mods[i])
+				}
+			}
+		})
+	}
+}
+
+func TestModuleFloor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const floor = 16 << 20
+	m := New("", "", "", createModules(t, dir, 10, 10), WithModuleFloor(floor))
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+	for i, mod := range m.loadedModules {
+		if mod.Start < floor {
+			t.Errorf("module %d: start %#x is below %#x", i, mod.Start, floor)
+		}
+	}
+}
+
+func TestModuleNormalization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("module"), 100)
+	compressed := bytes.Buffer{}
+	z := gzip.NewWriter(&compressed)
+	z.Name = "module"
+	if _, err := z.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "module.gz")
+	if err := ioutil.WriteFile(name, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	canonical := bytes.Buffer{}
+	z = gzip.NewWriter(&canonical)
+	if _, err := z.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name string
+		norm ModuleNormalization
+		want []byte
+	}{
+		{name: "decompress", norm: AlwaysDecompress, want: content},
+		{name: "passthrough", norm: Passthrough, want: compressed.Bytes()},
+		{name: "gzip", norm: AlwaysGzip, want: canonical.Bytes()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, data, _, err := loadModules(stdLogger{}, []ModuleSpec{{Path: name, CmdLine: name + " arg"}}, test.norm, 0)
+			if err != nil {
+				t.Fatalf("loadModules() error: %v", err)
+			}
+			if !bytes.Equal(data[0], test.want) {
+				t.Errorf("loadModules() got % x, want % x", data[0], test.want)
+			}
+		})
+	}
+}
+
+func TestModulesAboveKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel := kexec.Range{Start: 0x1000000, Size: 0x100000}
+	m := New("", "", "", createModules(t, dir, 10, 10), WithModulesAboveKernel())
+	m.mem.Phys = testMemory
+	m.mem.Segments = []kexec.Segment{kexec.NewSegment(make([]byte, kernel.Size), kernel)}
+	m.kernelEnd = kernel.Start + uintptr(kernel.Size)
+
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+	for i, mod := range m.loadedModules {
+		if uintptr(mod.Start) < m.kernelEnd {
+			t.Errorf("module %d: start %#x is below the kernel end %#x", i, mod.Start, m.kernelEnd)
+		}
+	}
+}
+
+func TestModuleRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mods := createModules(t, dir, 10, 10)
+	mods[0] += " dep=%MODADDR:b% index=%MODINDEX:" + filepath.Join(dir, "b") + "%"
+	m := New("", "", "", mods)
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+
+	want := fmt.Sprintf("%s arg dep=%#x index=1", filepath.Join(dir, "a"), m.loadedModules[1].Start)
+	got := segmentData(t, m.mem.Segments, uintptr(m.loadedModules[0].CmdLine), len(want)+1)
+	if string(got) != want+"\x00" {
+		t.Errorf("module command line got %q, want %q", got, want)
+	}
+
+	mods[0] = filepath.Join(dir, "a") + " dep=%MODADDR:c%"
+	m = New("", "", "", mods)
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err == nil {
+		t.Errorf("addModules() with unknown module reference got nil error, want error")
+	}
+}
+
+func TestCmdLinePlaceholder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mods := createModules(t, dir, 10, 10)
+	m := New("", "initrd=@INITRD@ index=%MODINDEX:a%", "", mods, WithCmdLinePlaceholder("@INITRD@", "b"))
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+
+	want := fmt.Sprintf("initrd=%#x index=0", m.loadedModules[1].Start)
+	if got := segmentData(t, m.mem.Segments, uintptr(m.info.CmdLine), len(want)+1); string(got) != want+"\x00" {
+		t.Errorf("command line got %q, want %q", got, want)
+	}
+
+	m = New("", "initrd=@INITRD@", "", mods, WithCmdLinePlaceholder("@INITRD@", "c"))
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err == nil {
+		t.Errorf("addInfo() with placeholder for unknown module got nil error, want error")
+	}
+	// Without placeholders, module references are passed verbatim.
+	const verbatim = "addr=%MODADDR:c% index=%MODINDEX:a%"
+	m = New("", verbatim, "", mods)
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(m.info.CmdLine), len(verbatim)+1); string(got) != verbatim+"\x00" {
+		t.Errorf("command line got %q, want %q", got, verbatim)
+	}
+}
+
+// testModules returns n modules with distinct field values.
+func testModules(n int) modules {
+	m := make(modules, n)
+	for i := range m {
+		m[i] = Module{
+			Start:   uint32(0x100000 + i*0x1000),
+			End:     uint32(0x100800 + i*0x1000),
+			CmdLine: uint32(0x2000 + i*16),
+		}
+	}
+	return m
+}
+
+func TestModulesMarshal(t *testing.T) {
+	m := testModules(100)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		want := bytes.Buffer{}
+		if err := binary.Write(&want, order, m); err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.marshal(order)
+		if err != nil {
+			t.Fatalf("marshal(%v) error: %v", order, err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("marshal(%v) output differs from binary.Write", order)
+		}
+
+		var w bytes.Buffer
+		if err := m.writeTo(&w, order); err != nil {
+			t.Fatalf("writeTo(%v) error: %v", order, err)
+		}
+		if !bytes.Equal(w.Bytes(), want.Bytes()) {
+			t.Errorf("writeTo(%v) output differs from binary.Write", order)
+		}
+	}
+}
+
+func TestModulesWriteCmdLines(t *testing.T) {
+	cmds := []string{"a", "", "module --arg"}
+	m := make(modules, len(cmds))
+	var w bytes.Buffer
+	if err := m.writeCmdLines(&w, cmds); err != nil {
+		t.Fatalf("writeCmdLines() error: %v", err)
+	}
+	if want := "a\x00\x00module --arg\x00"; w.String() != want {
+		t.Errorf("writeCmdLines() wrote %q, want %q", w.String(), want)
+	}
+	for i, want := range []uint32{0, 2, 3} {
+		if m[i].CmdLine != want {
+			t.Errorf("module %d: command line offset got %d, want %d", i, m[i].CmdLine, want)
+		}
+	}
+}
+
+func TestModulesReservedZero(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := New("", "", "", createModules(t, dir, 10, 20, 30))
+	m.mem.Phys = testMemory
+	addr, err := m.addModules()
+	if err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+	b := segmentData(t, m.mem.Segments, addr, len(m.loadedModules)*sizeofModule)
+	for i := range m.loadedModules {
+		if r := binary.LittleEndian.Uint32(b[i*sizeofModule+12:]); r != 0 {
+			t.Errorf("module %d: reserved field got %#x, want 0", i, r)
+		}
+	}
+
+	mods := testModules(3)
+	mods[1].Reserved = 1
+	if _, err := mods.marshal(binary.LittleEndian); err == nil {
+		t.Errorf("marshal() with nonzero reserved field got nil error, want error")
+	}
+}
+
+func BenchmarkModulesMarshal(b *testing.B) {
+	m := testModules(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.marshal(binary.LittleEndian); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNewWithModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules dir")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The module path contains a space.
+	name := filepath.Join(dir, "a")
+	if err := ioutil.WriteFile(name, []byte("module"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const cmdLine = "module  verbatim  args "
+	m := NewWithModules("", "", "", []ModuleSpec{{Path: name, CmdLine: cmdLine}})
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+
+	mod := m.loadedModules[0]
+	if got := segmentData(t, m.mem.Segments, uintptr(mod.Start), int(mod.End-mod.Start)); string(got) != "module" {
+		t.Errorf("module content got %q, want %q", got, "module")
+	}
+	if got := segmentData(t, m.mem.Segments, uintptr(mod.CmdLine), len(cmdLine)+1); string(got) != cmdLine+"\x00" {
+		t.Errorf("module command line got %q, want %q", got, cmdLine)
+	}
+}
+
+func TestModuleReader(t *testing.T) {
+	content := bytes.Repeat([]byte("module"), 100)
+	compressed := bytes.Buffer{}
+	z := gzip.NewWriter(&compressed)
+	if _, err := z.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The module does not exist in the file system.
+	r := bytes.NewReader(compressed.Bytes())
+	m := NewWithModules("", "", "", []ModuleSpec{{Path: "/nonexistent/module", CmdLine: "module arg", Reader: r, Size: r.Size()}})
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() error: %v", err)
+	}
+
+	mod := m.loadedModules[0]
+	if got := segmentData(t, m.mem.Segments, uintptr(mod.Start), int(mod.End-mod.Start)); !bytes.Equal(got, content) {
+		t.Errorf("module content got %q, want decompressed %q", got, content)
+	}
+}
+
+func TestModulesVerify(t *testing.T) {
+	segs := []kexec.Segment{
+		{Phys: kexec.Range{Start: 0x100000, Size: 0x2000}},
+		{Phys: kexec.Range{Start: 0x200000, Size: 0x1000}},
+	}
+	for _, test := range []struct {
+		name    string
+		mods    modules
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			mods: modules{{Start: 0x100000, End: 0x101000}, {Start: 0x101000, End: 0x102000}, {}, {Start: 0x200000, End: 0x200800}},
+		},
+		{
+			name: "shared",
+			mods: modules{{Start: 0x100000, End: 0x101000}, {Start: 0x100000, End: 0x101000}},
+		},
+		{
+			name:    "overlap",
+			mods:    modules{{Start: 0x100000, End: 0x101800}, {Start: 0x101000, End: 0x102000}},
+			wantErr: true,
+		},
+		{
+			name:    "outside_segment",
+			mods:    modules{{Start: 0x101000, End: 0x103000}},
+			wantErr: true,
+		},
+		{
+			name:    "end_below_start",
+			mods:    modules{{Start: 0x101000, End: 0x100000}},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.mods.verify(segs); (err != nil) != test.wantErr {
+				t.Errorf("verify() got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mods := createModules(t, dir, 0x100, 0x100)
+	kernel := strings.Fields(mods[0])[0]
+	other := strings.Fields(mods[1])[0]
+	for _, test := range []struct {
+		name          string
+		mods          []string
+		maxDuplicates int
+		wantErr       bool
+	}{
+		{name: "ok", mods: mods[1:], maxDuplicates: 1},
+		{name: "kernel", mods: []string{other, kernel}, wantErr: true},
+		{name: "kernel relative", mods: []string{filepath.Join(dir, ".", filepath.Base(kernel))}, wantErr: true},
+		{name: "duplicates allowed", mods: []string{other, other, other}, maxDuplicates: 3},
+		{name: "duplicates unlimited", mods: []string{other, other, other}},
+		{name: "too many duplicates", mods: []string{other, other, other}, maxDuplicates: 2, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := New(kernel, "", "", test.mods)
+			if err := m.ValidateModules(test.maxDuplicates); (err != nil) != test.wantErr {
+				t.Errorf("ValidateModules(%d) got error %v, want error %t", test.maxDuplicates, err, test.wantErr)
+			}
+		})
+	}
+
+	m := New(kernel, "", "", []string{kernel}, WithModuleValidation(0))
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err == nil {
+		t.Errorf("addModules() with the kernel as a module got nil error, want error")
+	}
+}
+
+func TestMaxModuleSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The compressed module is small, but decompresses
+	// to more than the limit.
+	compressed := bytes.Buffer{}
+	z := gzip.NewWriter(&compressed)
+	if _, err := z.Write(make([]byte, 0x10000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz := filepath.Join(dir, "gz")
+	if err := ioutil.WriteFile(gz, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw := strings.Fields(createModules(t, dir, 0x10000)[0])[0]
+
+	for _, test := range []struct {
+		name string
+		path string
+		norm ModuleNormalization
+		max  int64
+		want error
+	}{
+		{name: "gzip", path: gz, norm: AlwaysDecompress, max: 0x1000, want: ErrTooLarge},
+		{name: "gzip passthrough", path: gz, norm: Passthrough, max: 0x1000},
+		{name: "gzip no limit", path: gz, norm: AlwaysDecompress},
+		{name: "raw", path: raw, norm: AlwaysDecompress, max: 0xffff, want: ErrTooLarge},
+		{name: "raw passthrough", path: raw, norm: Passthrough, max: 0xffff, want: ErrTooLarge},
+		{name: "raw at limit", path: raw, norm: AlwaysDecompress, max: 0x10000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := readModule(ModuleSpec{Path: test.path}, test.norm, test.max); err != test.want {
+				t.Errorf("readModule() got error %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	m := New("", "", "", []string{gz}, WithMaxModuleSize(0x1000))
+	m.mem.Phys = testMemory
+	if _, err := m.addModules(); err == nil {
+		t.Errorf("addModules() got nil error, want error for module exceeding the limit")
+	}
+}
+
+func TestModuleReports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	compressed := bytes.Buffer{}
+	z := gzip.NewWriter(&compressed)
+	if _, err := z.Write(make([]byte, 0x10000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz := filepath.Join(dir, "gz")
+	if err := ioutil.WriteFile(gz, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	raw := strings.Fields(createModules(t, dir, 0x100)[0])[0]
+	gzSize := int64(compressed.Len())
+
+	for _, test := range []struct {
+		name string
+		norm ModuleNormalization
+		want []ModuleReport
+	}{
+		{
+			name: "decompress",
+			norm: AlwaysDecompress,
+			want: []ModuleReport{
+				{Path: gz, Format: FormatGzip, StoredSize: gzSize, DecompressedSize: 0x10000, StagedSize: 0x10000},
+				{Path: raw, Format: FormatRaw, StoredSize: 0x100, DecompressedSize: 0x100, StagedSize: 0x100},
+			},
+		},
+		{
+			name: "passthrough",
+			norm: Passthrough,
+			want: []ModuleReport{
+				{Path: gz, Format: FormatGzip, StoredSize: gzSize, StagedSize: gzSize},
+				{Path: raw, Format: FormatRaw, StoredSize: 0x100, DecompressedSize: 0x100, StagedSize: 0x100},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := New("", "", "", []string{gz, raw}, WithModuleNormalization(test.norm))
+			m.mem.Phys = testMemory
+			if _, err := m.addModules(); err != nil {
+				t.Fatalf("addModules() got error %v", err)
+			}
+			if got := m.ModuleReports(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ModuleReports() got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "modules")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mods := createModules(t, dir, 0x100, 0x2000)
+	m := New("", "", "", mods)
+	m.mem.Phys = testMemory
+	if got := m.Modules(); len(got) != 0 {
+		t.Errorf("Modules() before load got %+v, want none", got)
+	}
+	if _, err := m.addModules(); err != nil {
+		t.Fatalf("addModules() got error %v", err)
+	}
+
+	got := m.Modules()
+	if len(got) != len(mods) {
+		t.Fatalf("Modules() got %d modules, want %d", len(got), len(mods))
+	}
+	for i, mod := range got {
+		if want := strings.Fields(mods[i])[0]; mod.Path != want {
+			t.Errorf("module %d Path got %q, want %q", i, mod.Path, want)
+		}
+		if mod.Start != m.loadedModules[i].Start || mod.End != m.loadedModules[i].End {
+			t.Errorf("module %d got [%#x, %#x), want [%#x, %#x)", i, mod.Start, mod.End, m.loadedModules[i].Start, m.loadedModules[i].End)
+		}
+		if mod.CmdLine != mods[i] {
+			t.Errorf("module %d CmdLine got %q, want %q", i, mod.CmdLine, mods[i])
+		}
+		if got := string(segmentData(t, m.mem.Segments, uintptr(m.loadedModules[i].CmdLine), len(mod.CmdLine))); got != mod.CmdLine {
+			t.Errorf("module %d staged command line got %q, want %q", i, got, mod.CmdLine)
+		}
+	}
+}
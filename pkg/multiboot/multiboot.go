@@ -9,57 +9,248 @@ package multiboot
 
 import (
 	"bytes"
+	"context"
 	"debug/elf"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"unicode"
 
 	"github.com/u-root/u-root/pkg/kexec"
 	"github.com/u-root/u-root/pkg/multiboot/internal/trampoline"
 	"github.com/u-root/u-root/pkg/ubinary"
+	"golang.org/x/sys/unix"
 )
 
 const bootloader = "u-root kexec"
 
+// ErrUnsupportedEndianness is returned by Load if there is
+// no byte order to marshal multiboot structures in.
+var ErrUnsupportedEndianness = errors.New("unsupported byte order")
+
 // Multiboot defines parameters for working with multiboot kernels.
 type Multiboot struct {
 	mem kexec.Memory
+	// plan is the state of the load planned by Plan.
+	plan *Multiboot
+	// parsedMemoryMap is true if Load parsed the memory map of mem.
+	parsedMemoryMap bool
 
 	file    string
-	modules []string
+	modules []ModuleSpec
+	// maxModuleSize is the maximum size of a module after
+	// decompression. Zero means no limit.
+	maxModuleSize int64
+	// validateModules runs ValidateModules with
+	// maxDuplicateModules before loading the modules.
+	validateModules     bool
+	maxDuplicateModules int
+
+	// kernel is a reader of the kernel used instead of file,
+	// e.g. a pre-opened kernel file.
+	kernel io.ReadSeeker
+	// kernelFile is the file opened by NewFromBlockDevice,
+	// which is closed by Close.
+	kernelFile *os.File
+	// rawKernel disables decompression of the kernel.
+	rawKernel bool
 
 	cmdLine    string
 	bootloader string
+	// cmdLinePlaceholders maps placeholders in cmdLine
+	// to the modules, whose address replaces them.
+	cmdLinePlaceholders map[string]string
 
 	// trampoline is a path to an executable blob, which contains a trampoline segment.
 	// Trampoline sets machine to a specific state defined by multiboot v1 spec.
 	// https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Machine-state.
+	//
+	// If empty, the trampoline embedded into the running binary
+	// for the machine of the kernel is used. Trampoline files are
+	// deprecated and will be removed in future releases.
 	trampoline string
+	// generatedTrampoline uses the trampoline generated in Go
+	// if no trampoline file is given.
+	generatedTrampoline bool
+	// bootMagic is the value of EAX set by the trampoline.
+	bootMagic uint32
 
 	header Header
 
 	// infoAddr is a pointer to multiboot info.
 	infoAddr uintptr
+	// kernelEnd is the exclusive end of the loaded kernel image.
+	kernelEnd uintptr
 	// kernelEntry is a pointer to entry point of kernel.
 	kernelEntry uintptr
+	// machine is the machine the kernel is built for.
+	machine elf.Machine
+	// sectionHeaders is the ELF section header table of the kernel.
+	sectionHeaders *sectionHeaders
+	// symbolFile is an ELF file with the section headers and
+	// symbols of a stripped kernel.
+	symbolFile string
+	// drives are the BIOS drives passed in the drives info.
+	drives []Drive
+	// apmTable is the APM BIOS interface table passed to the kernel.
+	apmTable *APMTable
+	// aout is true if the kernel is loaded using the a.out kludge.
+	aout bool
+	// aoutSymtab and aoutStrtab are the a.out symbol
+	// and string tables of an a.out kludge kernel.
+	aoutSymtab []byte
+	aoutStrtab []byte
 	// EntryPoint is a pointer to trampoline.
 	EntryPoint uintptr
 
 	info          Info
 	loadedModules []Module
+	// moduleCmdLines are the module command lines passed
+	// to the kernel, with module references resolved.
+	moduleCmdLines []string
+	// moduleReports describe how the modules were read.
+	moduleReports []ModuleReport
+	// infoCmdLine is the kernel command line passed in the info,
+	// with module references resolved.
+	infoCmdLine string
+	// infoData is the buffer of the staged info segment.
+	infoData []byte
+
+	// byteOrder is the byte order of the loaded kernel.
+	byteOrder binary.ByteOrder
+
+	// infoAlign is the alignment of the multiboot info block size.
+	infoAlign uint
+
+	// mmapByType sorts the memory map by type, then by address.
+	mmapByType bool
+
+	// trimMmap drops reserved ranges above the last RAM range
+	// from the memory map.
+	trimMmap bool
+
+	// maxModuleCmdLine is the maximum length of a module
+	// command line, zero means no limit.
+	maxModuleCmdLine int
+
+	// moduleNorm defines how modules are transformed before staging.
+	moduleNorm ModuleNormalization
+
+	// moduleAlign is the alignment of modules, if larger than a page.
+	moduleAlign uint
+
+	// moduleFloor is the lowest address modules may be placed at.
+	moduleFloor uintptr
+	// modulesAboveKernel places modules above the kernel image.
+	modulesAboveKernel bool
+	// dedupModules places modules with identical content once.
+	dedupModules bool
+
+	// crashRegion is the memory reserved for the crash kernel,
+	// all segments placed by the loader are allocated in it.
+	crashRegion *kexec.Range
+
+	// configTable is the content of the ROM configuration table.
+	configTable []byte
+	// configTableFile is a file storing the ROM configuration table.
+	configTableFile string
+	// rsdp is the physical address of the ACPI RSDP
+	// passed in the config table.
+	rsdp *uintptr
+
+	// noBootLoaderName omits the bootloader name from the info.
+	noBootLoaderName bool
+
+	// separateInfoStrings places the strings of the info
+	// in a segment separate from the info.
+	separateInfoStrings bool
+
+	// infoChecksum stores a CRC32 of the info structure after it.
+	infoChecksum bool
+
+	// infoLayout is the order of the components placed after the info.
+	infoLayout []InfoComponent
+	// mmapFirst places the memory map right after the info.
+	mmapFirst bool
+
+	// bootDevice is the packed BIOS boot device, if set.
+	bootDevice *uint32
+
+	// videoModeSetter sets the video mode requested by the kernel.
+	videoModeSetter VideoModeSetter
+
+	// cmdLineValidator validates the kernel command line.
+	cmdLineValidator func(cmdLine string) error
+	// asciiCmdLines requires kernel and module command lines to be ASCII.
+	asciiCmdLines bool
+
+	// vendorInfo is appended to the multiboot info.
+	vendorInfo []byte
+
+	// logger logs the loading progress.
+	logger Logger
+
+	// upperMemoryFromMapOK derives upper memory from the memory
+	// map if there is no RAM at 1 megabyte.
+	upperMemoryFromMapOK bool
+
+	// inherited is the info of the currently running multiboot
+	// environment, which is partially passed through to the kernel.
+	inherited *Info
+}
+
+// below4G is the part of physical memory addressable by 32-bit
+// multiboot info pointers.
+var below4G = kexec.Range{Start: 0, Size: math.MaxUint32}
+
+// addr32 returns addr as a 32-bit address of the multiboot info.
+// It returns an error if the size bytes at addr do not fit below 4GB.
+func addr32(what string, addr uintptr, size uint) (uint32, error) {
+	if uint64(addr) > math.MaxUint32 || uint64(addr)+uint64(size) > math.MaxUint32+1 {
+		return 0, fmt.Errorf("%s at %#x of size %#x does not fit in 32 bits", what, addr, size)
+	}
+	return uint32(addr), nil
 }
 
+// defaultBootMagic is the value of EAX the kernel is entered with.
+const defaultBootMagic = trampoline.DefaultMagic
+
+// rangeTypes maps memory types to the types of the multiboot memory map.
+// Unknown types are passed as reserved.
 var rangeTypes = map[kexec.RangeType]uint32{
-	kexec.RangeRAM:     1,
-	kexec.RangeDefault: 2,
-	kexec.RangeNVACPI:  3,
-	kexec.RangeACPI:    3,
-	kexec.RangeNVS:     4,
+	kexec.RangeRAM:      1,
+	kexec.RangeDefault:  2,
+	kexec.RangeReserved: 2,
+	kexec.RangeACPI:     3,
+	kexec.RangeNVACPI:   4,
+	kexec.RangeUnusable: 5,
 }
 
 var sizeofMemoryMap = uint(binary.Size(MemoryMap{}))
 
+// memoryMapTypeNames are the names of the multiboot memory map types.
+var memoryMapTypeNames = map[uint32]string{
+	1: "available",
+	2: "reserved",
+	3: "ACPI reclaimable",
+	4: "ACPI NVS",
+	5: "defective",
+}
+
+// String returns the range and the type of m.
+func (m MemoryMap) String() string {
+	typ, ok := memoryMapTypeNames[m.Type]
+	if !ok {
+		typ = fmt.Sprintf("type %d", m.Type)
+	}
+	return fmt.Sprintf("[%#x, %#x) %s", m.BaseAddr, m.BaseAddr+m.Length, typ)
+}
+
 // MemoryMap represents a reserved range of memory passed via the Multiboot Info header.
 type MemoryMap struct {
 	// Size is the size of the associated structure in bytes.
@@ -75,83 +266,428 @@ type MemoryMap struct {
 type memoryMaps []MemoryMap
 
 // Probe checks if file is multiboot v1 kernel.
+//
+// ProbeFailure classifies the returned error.
 func Probe(file string) error {
+	_, err := ProbeHeader(file)
+	return err
+}
+
+// Loader returns m as a kexec.Loader.
+//
+// Its Probe checks if file is a multiboot v1 kernel, like the Probe
+// function, and if so makes file the kernel loaded by m. Its Load
+// is m.Load without debug output.
+func (m *Multiboot) Loader() kexec.Loader {
+	return loader{m}
+}
+
+// loader adapts Multiboot to kexec.Loader.
+type loader struct {
+	m *Multiboot
+}
+
+var _ kexec.Loader = loader{}
+
+func (l loader) Probe(file string) error {
+	if err := Probe(file); err != nil {
+		return err
+	}
+	l.m.file = file
+	l.m.kernel = nil
+	return nil
+}
+
+func (l loader) Load() error {
+	return l.m.Load(false)
+}
+
+func (l loader) Segments() []kexec.Segment {
+	return l.m.Segments()
+}
+
+// ProbeHeader is like Probe, but also returns the parsed multiboot header.
+func ProbeHeader(file string) (Header, error) {
 	b, err := readFile(file)
 	if err != nil {
-		return err
+		return Header{}, err
 	}
 	kernel := &kernelReader{buf: b}
-	_, err = parseHeader(kernel)
-	return err
+	hdr, err := parseHeader(kernel)
+	if err != nil {
+		return Header{}, err
+	}
+	if hdr.Flags&flagHeaderAoutKludge != 0 {
+		return hdr, nil
+	}
+	if _, err := elf.NewFile(kernel); err != nil {
+		return Header{}, ErrNotELF
+	}
+	return hdr, nil
 }
 
 // New returns a new Multiboot instance.
-func New(file, cmdLine, trampoline string, modules []string) *Multiboot {
-	return &Multiboot{
+//
+// Each module is a space separated module path and arguments,
+// which is passed to the kernel as the module command line.
+func New(file, cmdLine, trampoline string, modules []string, opts ...Option) *Multiboot {
+	return NewWithModules(file, cmdLine, trampoline, moduleSpecs(modules), opts...)
+}
+
+// NewWithModules is like New, but takes module paths
+// and command lines separately.
+func NewWithModules(file, cmdLine, trampoline string, modules []ModuleSpec, opts ...Option) *Multiboot {
+	m := &Multiboot{
 		file:       file,
 		modules:    modules,
 		cmdLine:    cmdLine,
 		trampoline: trampoline,
 		bootloader: bootloader,
 		mem:        kexec.Memory{},
+		infoAlign:  4,
+		byteOrder:  ubinary.NativeEndian,
+		logger:     stdLogger{},
+		bootMagic:  defaultBootMagic,
+
+		maxModuleSize: DefaultMaxModuleSize,
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
+}
+
+// NewFromFile returns a new Multiboot instance, which loads the kernel
+// from an already opened file instead of opening it by path.
+func NewFromFile(f *os.File, cmdLine, trampoline string, modules []string, opts ...Option) *Multiboot {
+	m := New(f.Name(), cmdLine, trampoline, modules, opts...)
+	m.kernel = f
+	return m
+}
+
+// NewFromBlockDevice returns a new Multiboot instance, which loads the
+// kernel stored in length bytes at offset of the block device dev,
+// e.g. a raw partition without a filesystem.
+//
+// The device is kept open to be read by Load,
+// the caller must call Close once done loading.
+func NewFromBlockDevice(dev string, offset, length int64, cmdLine string, modules []string, opts ...Option) (*Multiboot, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid kernel range of %d bytes at offset %d", length, offset)
+	}
+	f, err := os.Open(dev)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset+length > size {
+		f.Close()
+		return nil, fmt.Errorf("kernel range of %d bytes at offset %d exceeds %v of %d bytes", length, offset, dev, size)
+	}
+	m := New(dev, cmdLine, "", modules, opts...)
+	m.kernel = io.NewSectionReader(f, offset, length)
+	m.kernelFile = f
+	return m, nil
+}
+
+// Close closes the block device opened by NewFromBlockDevice.
+// It does nothing for Multiboot instances created otherwise;
+// files passed to NewFromFile stay owned by the caller.
+func (m *Multiboot) Close() error {
+	if m.kernelFile == nil {
+		return nil
+	}
+	err := m.kernelFile.Close()
+	m.kernelFile = nil
+	return err
+}
+
+// InheritInfo passes the memory information, the boot device and
+// the memory map from src, e.g. the info of the currently running
+// multiboot environment, through to the loaded kernel.
+//
+// Only the fields marked as valid in src.Flags are copied.
+// src is copied when InheritInfo is called, later changes
+// of src are not passed on.
+// The memory map pointed by src is not copied, the caller
+// has to ensure that it survives kexec.
+func (m *Multiboot) InheritInfo(src *Info) {
+	if src == nil {
+		m.inherited = nil
+		return
+	}
+	info := *src
+	m.inherited = &info
 }
 
 // Load loads and parses multiboot information from m.file.
+//
+// The physical memory map is read from the firmware
+// unless it was already populated.
+//
+// Only multiboot kernels can be loaded. Multiboot2 kernels are
+// detected, but rejected with ErrMultiboot2NotSupported, or with
+// the error of ParseHeader2 if their header is not valid.
 func (m *Multiboot) Load(debug bool) error {
-	log.Printf("Parsing file %v", m.file)
-	b, err := readFile(m.file)
+	return m.LoadCtx(context.Background(), debug)
+}
+
+// LoadCtx is like Load, but stops early with the context
+// error if ctx is done between the stages of loading.
+func (m *Multiboot) LoadCtx(ctx context.Context, debug bool) error {
+	if m.byteOrder == nil {
+		return ErrUnsupportedEndianness
+	}
+
+	m.logger.Printf("Parsing file %v", m.file)
+	b, err := m.readKernel()
 	if err != nil {
-		return err
+		return &LoadError{Stage: ErrReadKernel, Err: err}
 	}
 	kernel := kernelReader{buf: b}
-	log.Println("Parsing Multiboot Header")
-	if m.header, err = parseHeader(&kernel); err != nil {
-		return fmt.Errorf("Error parsing headers: %v", err)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	log.Printf("Getting kernel entry point")
-	if m.kernelEntry, err = getEntryPoint(kernel); err != nil {
-		return fmt.Errorf("Error getting kernel entry point: %v", err)
+	m.logger.Printf("Parsing Multiboot Header")
+	var hdrOff int
+	if m.header, hdrOff, err = findHeader(&kernel); err == ErrHeaderNotFound {
+		// Report why a multiboot2 kernel cannot be loaded.
+		if _, err2 := ParseHeader2(&kernelReader{buf: b}); err2 == nil {
+			err = ErrMultiboot2NotSupported
+		} else if err2 != ErrHeaderNotFound {
+			err = err2
+		}
+	}
+	if err != nil {
+		return &LoadError{Stage: ErrParseHeader, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	log.Printf("Parsing ELF segments")
-	if err := m.mem.LoadElfSegments(kernel); err != nil {
-		return fmt.Errorf("Error loading ELF segments: %v", err)
+	if m.header.Flags&flagHeaderAoutKludge != 0 {
+		m.logger.Printf("Loading a.out kludge kernel")
+		// a.out kludge kernels are always 32-bit.
+		m.machine = elf.EM_386
+		if err := m.loadAout(b, hdrOff); err != nil {
+			return &LoadError{Stage: ErrLoadSegments, Op: "error loading a.out kernel", Err: err}
+		}
+	} else {
+		// Reserve the kernel ranges before anything else
+		// is placed, so nothing is allocated into them.
+		m.logger.Printf("Reserving kernel memory")
+		if err := m.reserveKernel(kernel); err != nil {
+			return &LoadError{Stage: ErrLoadSegments, Op: "error reserving kernel memory", Err: err}
+		}
+		if err := m.checkKernelAlignment(kernel); err != nil {
+			return &LoadError{Stage: ErrLoadSegments, Op: "error checking kernel alignment", Err: err}
+		}
+
+		m.logger.Printf("Getting kernel entry point")
+		if m.kernelEntry, m.machine, err = getEntryPoint(kernel); err != nil {
+			return &LoadError{Stage: ErrEntryPoint, Err: err}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		m.logger.Printf("Parsing ELF segments")
+		if err := m.mem.LoadElfSegments(kernel); err != nil {
+			return &LoadError{Stage: ErrLoadSegments, Op: "error loading ELF segments", Err: err}
+		}
+
+		m.logger.Printf("Reading ELF section headers")
+		syms := b
+		if m.symbolFile != "" {
+			if syms, err = ioutil.ReadFile(m.symbolFile); err != nil {
+				return &LoadError{Stage: ErrSectionHeaders, Op: "error reading symbol file", Err: err}
+			}
+		}
+		if m.sectionHeaders, err = readSectionHeaders(syms); err != nil {
+			return &LoadError{Stage: ErrSectionHeaders, Err: err}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, s := range m.mem.Segments {
+		if end := s.Phys.Start + uintptr(s.Phys.Size); end > m.kernelEnd {
+			m.kernelEnd = end
+		}
 	}
 
-	log.Printf("Parsing memory map")
-	if err := m.mem.ParseMemoryMap(); err != nil {
-		return fmt.Errorf("Error parsing memory map: %v", err)
+	if len(m.mem.Phys) == 0 {
+		m.logger.Printf("Parsing memory map")
+		if err := m.mem.ParseMemoryMap(); err != nil {
+			return &LoadError{Stage: ErrMemoryMap, Err: err}
+		}
+		m.parsedMemoryMap = true
+	}
+	if m.crashRegion != nil {
+		m.mem.LimitTo(*m.crashRegion)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	log.Printf("Preparing Multiboot Info")
+	m.logger.Printf("Preparing Multiboot Info")
 	if m.infoAddr, err = m.addInfo(); err != nil {
-		return fmt.Errorf("Error preparing Multiboot Info: %v", err)
+		return &LoadError{Stage: ErrInfo, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	log.Printf("Adding trampoline")
+	m.logger.Printf("Adding trampoline")
 	if m.EntryPoint, err = m.addTrampoline(); err != nil {
-		return fmt.Errorf("Error adding trampoline: %v", err)
+		return &LoadError{Stage: ErrTrampoline, Err: err}
+	}
+
+	if err := m.mem.Validate(); err != nil {
+		return &LoadError{Stage: ErrValidate, Err: err}
 	}
 
 	if debug {
 		info, err := m.Description()
 		if err != nil {
-			log.Printf("%v cannot create debug info: %v", DebugPrefix, err)
+			m.logger.Printf("%v cannot create debug info: %v", DebugPrefix, err)
+		}
+		m.logger.Printf("%v %v", DebugPrefix, info)
+	}
+
+	return nil
+}
+
+// Reset drops the segments and the state of the last Load, so that
+// Load can be called again, e.g. after a failed attempt.
+// The configuration, such as the kernel, the modules, the command line
+// and the options, is preserved.
+//
+// The physical memory map is parsed again on the next Load,
+// unless it was set with WithMemoryMap.
+func (m *Multiboot) Reset() {
+	m.mem.Segments = nil
+	m.mem.Reserved = nil
+	if m.parsedMemoryMap {
+		m.mem.Phys = nil
+		m.parsedMemoryMap = false
+	}
+	m.plan = nil
+
+	m.header = Header{}
+	m.infoAddr = 0
+	m.kernelEnd = 0
+	m.kernelEntry = 0
+	m.machine = 0
+	m.sectionHeaders = nil
+	m.aout = false
+	m.EntryPoint = 0
+
+	m.info = Info{}
+	m.loadedModules = nil
+	m.moduleCmdLines = nil
+	m.moduleReports = nil
+	m.infoCmdLine = ""
+	m.infoData = nil
+}
+
+func (m *Multiboot) readKernel() ([]byte, error) {
+	if m.rawKernel {
+		if m.kernel != nil {
+			if _, err := m.kernel.Seek(0, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("cannot rewind file: %v", err)
+			}
+			return ioutil.ReadAll(m.kernel)
 		}
-		log.Printf("%v %v", DebugPrefix, info)
+		return ioutil.ReadFile(m.file)
+	}
+	if m.kernel != nil {
+		return readSeeker(m.kernel)
+	}
+	return readFile(m.file)
+}
+
+// getEntryPoint returns the entry point of the kernel
+// and the machine it is built for.
+func getEntryPoint(r io.ReaderAt) (uintptr, elf.Machine, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := validateKernel(f.Class, f.Machine); err != nil {
+		return 0, 0, err
 	}
+	// The kernel is entered in 32-bit protected mode, the trampoline
+	// stores the entry point as a 32-bit value.
+	if f.Entry > math.MaxUint32 {
+		return 0, 0, fmt.Errorf("entry point %#x does not fit below 4GB", f.Entry)
+	}
+	return uintptr(f.Entry), f.Machine, nil
+}
 
+// kernelMachines are the supported ELF machines of a kernel by class.
+var kernelMachines = map[elf.Class]elf.Machine{
+	elf.ELFCLASS32: elf.EM_386,
+	elf.ELFCLASS64: elf.EM_X86_64,
+}
+
+// validateKernel checks that an ELF kernel of the given class
+// and machine can be booted by the trampoline.
+func validateKernel(class elf.Class, machine elf.Machine) error {
+	want, ok := kernelMachines[class]
+	if !ok {
+		return fmt.Errorf("unsupported ELF class %v", class)
+	}
+	if machine != want {
+		return fmt.Errorf("unsupported machine %v for %v kernel, want %v", machine, class, want)
+	}
 	return nil
 }
 
-func getEntryPoint(r io.ReaderAt) (uintptr, error) {
+// reserveKernel reserves the physical ranges of
+// the loadable ELF segments of the kernel.
+func (m *Multiboot) reserveKernel(r io.ReaderAt) error {
 	f, err := elf.NewFile(r)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		m.mem.Reserved = append(m.mem.Reserved, kexec.Range{
+			Start: uintptr(p.Paddr),
+			Size:  uint(p.Memsz),
+		})
+	}
+	return nil
+}
+
+// checkKernelAlignment warns if the physical address of the first
+// loadable ELF segment of the kernel is not aligned to its p_align.
+//
+// The kernel is loaded at the physical addresses it is linked at,
+// so it cannot be moved to honor the alignment.
+func (m *Multiboot) checkKernelAlignment(r io.ReaderAt) error {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return err
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if p.Align > 1 && p.Paddr%p.Align != 0 {
+			m.logger.Printf("Warning: kernel is loaded at %#x, which is not aligned to %#x requested by its first loadable segment", p.Paddr, p.Align)
+		}
+		return nil
 	}
-	return uintptr(f.Entry), err
+	return nil
 }
 
 func (m *Multiboot) addInfo() (addr uintptr, err error) {
@@ -159,12 +695,18 @@ func (m *Multiboot) addInfo() (addr uintptr, err error) {
 	if err != nil {
 		return 0, err
 	}
+	if m.separateInfoStrings {
+		if iw.stringsAddr, err = m.mem.AddKexecSegmentIn(iw.strings(), below4G); err != nil {
+			return 0, err
+		}
+		iw.separateStrings = true
+	}
 	infoSize, err := iw.size()
 	if err != nil {
 		return 0, err
 	}
 
-	addr, err = m.mem.FindSpace(infoSize)
+	addr, err = m.mem.FindSpaceIn(infoSize, below4G)
 	if err != nil {
 		return 0, err
 	}
@@ -174,20 +716,52 @@ func (m *Multiboot) addInfo() (addr uintptr, err error) {
 		return 0, err
 	}
 	m.info = iw.Info
+	m.infoCmdLine = iw.CmdLine
+	m.infoData = d
 
-	addr, err = m.mem.AddKexecSegment(d)
+	addr, err = m.mem.AddKexecSegmentIn(d, below4G)
 	if err != nil {
 		return 0, err
 	}
 	return addr, nil
 }
 
+// PreviewInfo returns the multiboot info, the command line and the
+// bootloader name passed to the kernel, without staging any segments.
+// The addresses in the info are those the next staged info would have.
+//
+// The info reflects the kernel header parsed so far, if any.
+// The video mode is not set, the requested mode is reported instead.
+func (m *Multiboot) PreviewInfo() (Info, string, string, error) {
+	mem, loaded, cmds, reports := m.mem, m.loadedModules, m.moduleCmdLines, m.moduleReports
+	info, cmdLine, data, setter := m.info, m.infoCmdLine, m.infoData, m.videoModeSetter
+	defer func() {
+		m.mem, m.loadedModules, m.moduleCmdLines, m.moduleReports = mem, loaded, cmds, reports
+		m.info, m.infoCmdLine, m.infoData, m.videoModeSetter = info, cmdLine, data, setter
+	}()
+	// Segments and reserved ranges added for the preview
+	// must not share the arrays of the staged ones.
+	m.mem.Segments = append([]kexec.Segment(nil), mem.Segments...)
+	m.mem.Reserved = append([]kexec.Range(nil), mem.Reserved...)
+	m.videoModeSetter = nil
+
+	if _, err := m.addInfo(); err != nil {
+		return Info{}, "", "", err
+	}
+	bootloader := m.bootloader
+	if m.noBootLoaderName {
+		bootloader = ""
+	}
+	return m.info, m.infoCmdLine, bootloader, nil
+}
+
 func (m Multiboot) memoryMap() memoryMaps {
 	var ret memoryMaps
 	for _, r := range m.mem.Phys {
 		typ, ok := rangeTypes[r.Type]
 		if !ok {
-			typ = rangeTypes[kexec.RangeDefault]
+			m.logger.Printf("Warning: memory range [%#x, %#x) of unknown type %q is passed as reserved", r.Start, r.Start+uintptr(r.Size), r.Type)
+			typ = rangeTypes[kexec.RangeReserved]
 		}
 		v := MemoryMap{
 			// Size is really used for skipping to the next pair.
@@ -198,85 +772,410 @@ func (m Multiboot) memoryMap() memoryMaps {
 		}
 		ret = append(ret, v)
 	}
+	// Kernels expect an e820-style map sorted by address.
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].BaseAddr < ret[j].BaseAddr
+	})
+	ret = ret.coalesce()
+	if m.trimMmap {
+		ret = ret.trim()
+	}
+	if m.mmapByType {
+		sort.SliceStable(ret, func(i, j int) bool {
+			if ret[i].Type != ret[j].Type {
+				return ret[i].Type < ret[j].Type
+			}
+			return ret[i].BaseAddr < ret[j].BaseAddr
+		})
+		ret = ret.coalesce()
+	}
+	return ret
+}
+
+// trim drops non-RAM entries above the last RAM entry.
+func (m memoryMaps) trim() memoryMaps {
+	ram := rangeTypes[kexec.RangeRAM]
+	var end uint64
+	for _, v := range m {
+		if v.Type == ram && v.BaseAddr+v.Length > end {
+			end = v.BaseAddr + v.Length
+		}
+	}
+	var ret memoryMaps
+	for _, v := range m {
+		if v.Type == ram || v.BaseAddr < end {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// coalesce merges adjacent entries of the same type.
+// m has to be sorted by address, or by type and address.
+func (m memoryMaps) coalesce() memoryMaps {
+	var ret memoryMaps
+	for _, v := range m {
+		if n := len(ret); n > 0 && ret[n-1].Type == v.Type && ret[n-1].BaseAddr+ret[n-1].Length == v.BaseAddr {
+			ret[n-1].Length += v.Length
+			continue
+		}
+		ret = append(ret, v)
+	}
 	return ret
 }
 
 func (m *Multiboot) addMmap() (addr uintptr, size uint, err error) {
 	mmap := m.memoryMap()
-	d, err := mmap.marshal()
+	d, err := mmap.marshal(m.byteOrder)
 	if err != nil {
 		return 0, 0, err
 	}
-	addr, err = m.mem.AddKexecSegment(d)
+	addr, err = m.mem.AddKexecSegmentIn(d, below4G)
 	if err != nil {
 		return 0, 0, err
 	}
 	return addr, uint(len(mmap)) * sizeofMemoryMap, nil
 }
 
-func (m Multiboot) memoryBoundaries() (lower, upper uint32) {
-	const M1 = 1048576
-	const K640 = 640 * 1024
-	for _, r := range m.mem.Phys {
-		if r.Type != kexec.RangeRAM {
-			continue
+// maxConfigTableSize is the maximum size of the ROM configuration table.
+const maxConfigTableSize = 64 << 10
+
+func (m *Multiboot) addConfigTable() (uintptr, error) {
+	if m.rsdp != nil {
+		if m.configTable != nil || m.configTableFile != "" {
+			return 0, fmt.Errorf("RSDP and config table are both passed in the config table")
+		}
+		d, err := readRSDP(*m.rsdp)
+		if err != nil {
+			return 0, err
+		}
+		return m.mem.AddKexecSegmentIn(d, below4G)
+	}
+
+	d := m.configTable
+	if m.configTableFile != "" {
+		fi, err := os.Stat(m.configTableFile)
+		if err != nil {
+			return 0, err
 		}
-		end := uint32(r.Start) + uint32(r.Size)
-		// Lower memory starts at address 0, and upper memory starts at address 1 megabyte.
-		// The maximum possible value for lower memory is 640 kilobytes.
-		// The value returned for upper memory is maximally the address of the first upper memory hole minus 1 megabyte.
-		// It is not guaranteed to be this value.
-		if r.Start <= K640 && end > lower {
-			lower = end
+		if fi.Size() > maxConfigTableSize {
+			return 0, fmt.Errorf("config table file %v is %d bytes, exceeds limit of %d bytes", m.configTableFile, fi.Size(), maxConfigTableSize)
 		}
-		if r.Start <= M1 && end > upper+M1 {
-			upper = end - M1
+		if d, err = ioutil.ReadFile(m.configTableFile); err != nil {
+			return 0, err
 		}
 	}
+	if len(d) == 0 {
+		return 0, fmt.Errorf("config table is empty")
+	}
+	if len(d) > maxConfigTableSize {
+		return 0, fmt.Errorf("config table is %d bytes, exceeds limit of %d bytes", len(d), maxConfigTableSize)
+	}
+	return m.mem.AddKexecSegmentIn(d, below4G)
+}
+
+// memoryBoundaries returns the sizes of lower and upper memory in bytes.
+//
+// Lower memory starts at address 0, and upper memory starts at address 1 megabyte.
+// The maximum possible value for lower memory is 640 kilobytes.
+// The value returned for upper memory is the address of the first upper memory hole minus 1 megabyte.
+func (m Multiboot) memoryBoundaries() (lower, upper uint64) {
+	const K640 = 640 * 1024
+	lower = min(m.ramEnd(0), K640)
+	upper = m.ramEnd(upperMemoryStart) - upperMemoryStart
 	return
 }
 
-func min(a, b uint32) uint32 {
+// upperMemoryStart is the address upper memory starts at.
+const upperMemoryStart = 1048576
+
+// upperMemoryFromMap returns the size of upper memory derived from
+// the memory map if there is no RAM at 1 megabyte: the end of the first
+// RAM above 1 megabyte minus 1 megabyte. It returns false if there
+// is no RAM above 1 megabyte.
+func (m Multiboot) upperMemoryFromMap() (upper uint64, ok bool) {
+	first := uint64(math.MaxUint64)
+	for _, r := range m.mem.Phys {
+		if start := uint64(r.Start); r.Type == kexec.RangeRAM && r.Size > 0 && start >= upperMemoryStart && start < first {
+			first = start
+		}
+	}
+	if first == math.MaxUint64 {
+		return 0, false
+	}
+	return m.ramEnd(first) - upperMemoryStart, true
+}
+
+// ramEnd returns the exclusive end of the contiguous RAM starting at addr,
+// which may span several adjacent RAM ranges.
+// It returns addr if addr is not in RAM.
+//
+// Ranges parsed from the firmware memory map are one byte short,
+// so their end is adjusted the same way as in memoryMap.
+func (m Multiboot) ramEnd(addr uint64) uint64 {
+	end := addr
+	for grown := true; grown; {
+		grown = false
+		for _, r := range m.mem.Phys {
+			if r.Type != kexec.RangeRAM {
+				continue
+			}
+			start := uint64(r.Start)
+			if rEnd := start + uint64(r.Size) + 1; start <= end && rEnd > end {
+				end = rEnd
+				grown = true
+			}
+		}
+	}
+	return end
+}
+
+func min(a, b uint64) uint64 {
 	if a < b {
 		return a
 	}
 	return b
 }
 
+// checkASCII returns an error if cmdLine is not a valid
+// zero-terminated ASCII string once the terminator is appended.
+func checkASCII(cmdLine string) error {
+	for i := 0; i < len(cmdLine); i++ {
+		switch c := cmdLine[i]; {
+		case c == 0:
+			return fmt.Errorf("NUL byte at offset %d terminates the command line early", i)
+		case c > unicode.MaxASCII:
+			return fmt.Errorf("non-ASCII byte %#x at offset %d", c, i)
+		}
+	}
+	return nil
+}
+
 func (m *Multiboot) newMultibootInfo() (*infoWrapper, error) {
-	mmapAddr, mmapSize, err := m.addMmap()
-	if err != nil {
-		return nil, err
+	if m.asciiCmdLines {
+		if err := checkASCII(m.cmdLine); err != nil {
+			return nil, fmt.Errorf("invalid kernel command line %q: %v", m.cmdLine, err)
+		}
+	}
+	if m.cmdLineValidator != nil {
+		if err := m.cmdLineValidator(m.cmdLine); err != nil {
+			return nil, fmt.Errorf("invalid kernel command line %q: %v", m.cmdLine, err)
+		}
+	}
+
+	var layout []InfoComponent
+	order := m.infoLayout
+	if m.mmapFirst {
+		if m.infoChecksum {
+			return nil, fmt.Errorf("memory map cannot directly follow the info with an info checksum")
+		}
+		order = []InfoComponent{InfoMemoryMap}
+		for _, c := range m.infoLayout {
+			if c != InfoMemoryMap {
+				order = append(order, c)
+			}
+		}
+	}
+	if order != nil {
+		if m.separateInfoStrings {
+			return nil, fmt.Errorf("info layout cannot be used with separate info strings")
+		}
+		var err error
+		if layout, err = infoLayout(order); err != nil {
+			return nil, err
+		}
+	}
+	contiguous := func(c InfoComponent) bool {
+		for _, l := range layout {
+			if l == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The memory map and the module list are placed after
+	// the info if they are in the layout.
+	var mmapData, modsData []byte
+	var mmapAddr32 uint32
+	var mmapSize uint
+	if contiguous(InfoMemoryMap) {
+		mmap := m.memoryMap()
+		var err error
+		if mmapData, err = mmap.marshal(m.byteOrder); err != nil {
+			return nil, err
+		}
+		mmapSize = uint(len(mmapData))
+	} else {
+		mmapAddr, size, err := m.addMmap()
+		if err != nil {
+			return nil, err
+		}
+		if mmapAddr32, err = addr32("memory map", mmapAddr, size); err != nil {
+			return nil, err
+		}
+		mmapSize = size
 	}
 	var info Info
 	if m.header.Flags&flagHeaderMemoryInfo != 0 {
 		lower, upper := m.memoryBoundaries()
+		if upper == 0 && (m.inherited == nil || m.inherited.Flags&flagInfoMemory == 0) {
+			// Kernels told there is no upper memory may hang,
+			// although the memory map shows RAM above 1 megabyte.
+			if fromMap, ok := m.upperMemoryFromMap(); ok {
+				if !m.upperMemoryFromMapOK {
+					return nil, fmt.Errorf("no RAM at 1MB, upper memory would be 0 while the memory map has RAM up to %#x; use WithUpperMemoryFromMap to report it", fromMap+upperMemoryStart)
+				}
+				m.logger.Printf("No RAM at 1MB, reporting %#x bytes of upper memory from the memory map", fromMap)
+				upper = fromMap
+			}
+		}
 		info = Info{
 			Flags:      flagInfoMemMap | flagInfoMemory,
-			MemLower:   min(uint32(lower>>10), 0xFFFFFFFF),
-			MemUpper:   min(uint32(upper>>10), 0xFFFFFFFF),
+			MemLower:   uint32(lower >> 10),
+			MemUpper:   uint32(min(upper>>10, math.MaxUint32)),
 			MmapLength: uint32(mmapSize),
-			MmapAddr:   uint32(mmapAddr),
+			MmapAddr:   mmapAddr32,
 		}
 	}
 
 	if len(m.modules) > 0 {
-		modAddr, err := m.addModules()
-		if err != nil {
-			return nil, err
+		if contiguous(InfoModules) {
+			var err error
+			if modsData, err = m.prepareModules(); err != nil {
+				return nil, err
+			}
+		} else {
+			modAddr, err := m.addModules()
+			if err != nil {
+				return nil, err
+			}
+			info.ModsAddr, err = addr32("module list", modAddr, uint(len(m.modules)*sizeofModule))
+			if err != nil {
+				return nil, err
+			}
 		}
 		info.Flags |= flagInfoMods
-		info.ModsAddr = uint32(modAddr)
 		info.ModsCount = uint32(len(m.modules))
 	}
 
+	if info.Flags&flagInfoMemMap == 0 {
+		mmapData = nil
+	}
+
+	// Module addresses are known once the modules are placed.
+	cmdLine, err := m.resolveCmdLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if src := m.inherited; src != nil {
+		if src.Flags&flagInfoMemory != 0 {
+			info.Flags |= flagInfoMemory
+			info.MemLower = src.MemLower
+			info.MemUpper = src.MemUpper
+		}
+		if src.Flags&flagInfoBootDev != 0 {
+			info.Flags |= flagInfoBootDev
+			info.BootDevice = src.BootDevice
+		}
+		if src.Flags&flagInfoMemMap != 0 {
+			info.Flags |= flagInfoMemMap
+			info.MmapAddr = src.MmapAddr
+			info.MmapLength = src.MmapLength
+			mmapData = nil
+		}
+	}
+
+	if len(m.drives) > 0 {
+		addr, size, err := m.addDrives()
+		if err != nil {
+			return nil, fmt.Errorf("cannot add drives info: %v", err)
+		}
+		info.Flags |= flagInfoDriveInfo
+		info.DrivesLength = uint32(size)
+		info.DrivesAddr, err = addr32("drives info", addr, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a.out symbols and ELF section headers are mutually exclusive.
+	if m.aout {
+		if m.aoutSymtab != nil || m.aoutStrtab != nil {
+			syms, err := m.addAoutSymbols()
+			if err != nil {
+				return nil, err
+			}
+			info.Flags |= flagInfoAoutSyms
+			info.Syms = syms
+		}
+	} else if m.sectionHeaders != nil {
+		syms, err := m.addSectionHeaders()
+		if err != nil {
+			return nil, err
+		}
+		info.Flags |= flagInfoElfSHDR
+		info.Syms = syms
+	}
+
+	if m.bootDevice != nil {
+		info.Flags |= flagInfoBootDev
+		info.BootDevice = *m.bootDevice
+	}
+
+	if m.header.Flags&flagHeaderMultibootVideoMode != 0 {
+		fb, err := m.videoMode()
+		if err != nil {
+			return nil, fmt.Errorf("cannot set video mode: %v", err)
+		}
+		info.setFramebuffer(fb)
+	}
+
+	if m.configTable != nil || m.configTableFile != "" || m.rsdp != nil {
+		addr, err := m.addConfigTable()
+		if err != nil {
+			return nil, err
+		}
+		info.Flags |= flagInfoConfigTable
+		info.ConfigTable, err = addr32("config table", addr, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.apmTable != nil {
+		addr, err := m.addAPMTable()
+		if err != nil {
+			return nil, err
+		}
+		info.Flags |= flagInfoAPMTable
+		info.APMTable, err = addr32("APM table", addr, sizeofAPMTable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	info.CmdLine = sizeofInfo
-	info.BootLoaderName = sizeofInfo + uint32(len(m.cmdLine)) + 1
-	info.Flags |= flagInfoCmdLine | flagInfoBootLoaderName
+	info.Flags |= flagInfoCmdLine
+	bootloader := m.bootloader
+	if m.noBootLoaderName {
+		bootloader = ""
+	} else {
+		info.BootLoaderName = sizeofInfo + uint32(len(cmdLine)) + 1
+		info.Flags |= flagInfoBootLoaderName
+	}
 	return &infoWrapper{
 		Info:           info,
-		CmdLine:        m.cmdLine,
-		BootLoaderName: m.bootloader,
+		CmdLine:        cmdLine,
+		BootLoaderName: bootloader,
+		Vendor:         m.vendorInfo,
+		checksum:       m.infoChecksum,
+		layout:         layout,
+		mmap:           mmapData,
+		mods:           modsData,
+		align:          m.infoAlign,
+		order:          m.byteOrder,
 	}, nil
 }
 
@@ -286,19 +1185,86 @@ func (m Multiboot) Segments() []kexec.Segment {
 	return m.mem.Segments
 }
 
+// LowMemoryUsed returns the number of bytes of the loaded
+// segments placed below 4GB.
+func (m Multiboot) LowMemoryUsed() uint {
+	const end = 1 << 32
+	var used uint64
+	for _, s := range m.mem.Segments {
+		start := uint64(s.Phys.Start)
+		if start >= end {
+			continue
+		}
+		size := uint64(s.Phys.Size)
+		if end-start < size {
+			size = end - start
+		}
+		used += size
+	}
+	return uint(used)
+}
+
+// KexecArgs returns the arguments passed to kexec_load(2)
+// to boot the loaded kernel, without executing it.
+// flags is unix.KEXEC_ON_CRASH if the kernel is loaded
+// with WithCrashKernelRegion.
+func (m Multiboot) KexecArgs() (entry uintptr, flags int, segments []kexec.Segment, err error) {
+	segments, err = kexec.Prepare(m.EntryPoint, m.mem.Segments)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if m.crashRegion != nil {
+		flags = unix.KEXEC_ON_CRASH
+	}
+	return m.EntryPoint, flags, segments, nil
+}
+
+// kexecLoad loads segments with kexec_load(2).
+var kexecLoad = kexec.Load
+
+// KexecWithFlags loads the multiboot image with kexec_load(2) flags,
+// e.g. unix.KEXEC_ON_CRASH to load it as the crash kernel.
+//
+// KEXEC_ON_CRASH requires all segments to lie within the
+// crash kernel region configured with WithCrashKernelRegion.
+func (m Multiboot) KexecWithFlags(flags int) error {
+	if flags&unix.KEXEC_ON_CRASH != 0 {
+		if m.crashRegion == nil {
+			return errors.New("loading on crash requires the crash kernel region")
+		}
+		for _, s := range m.mem.Segments {
+			if !m.crashRegion.IsSupersetOf(s.Phys) {
+				return fmt.Errorf("segment [%#x, %#x) is outside of the crash kernel region [%#x, %#x)",
+					s.Phys.Start, s.Phys.Start+uintptr(s.Phys.Size), m.crashRegion.Start, m.crashRegion.Start+uintptr(m.crashRegion.Size))
+			}
+		}
+	}
+	return kexecLoad(m.EntryPoint, m.mem.Segments, uint64(flags))
+}
+
 // marshal writes out the exact bytes expected by the multiboot info header
 // specified in
 // https://www.gnu.org/software/grub/manual/multiboot/multiboot.html#Boot-information-format.
-func (m memoryMaps) marshal() ([]byte, error) {
+func (m memoryMaps) marshal(order binary.ByteOrder) ([]byte, error) {
 	buf := bytes.Buffer{}
-	err := binary.Write(&buf, ubinary.NativeEndian, m)
+	err := binary.Write(&buf, order, m)
 	return buf.Bytes(), err
 }
 
 func (m *Multiboot) addTrampoline() (entry uintptr, err error) {
 	// Trampoline setups the machine registers to desired state
 	// and executes the loaded kernel.
-	d, err := trampoline.Setup(m.trampoline, m.infoAddr, m.kernelEntry)
+	if m.trampoline == "" && m.generatedTrampoline {
+		return m.addGeneratedTrampoline()
+	}
+
+	var d []byte
+	if m.trampoline == "" {
+		d, err = trampoline.SetupEmbedded(m.machine, m.infoAddr, m.kernelEntry, m.bootMagic)
+	} else {
+		m.logger.Printf("Warning: trampoline file %v is deprecated, pass an empty path to use the embedded trampoline", m.trampoline)
+		d, err = trampoline.Setup(m.trampoline, m.infoAddr, m.kernelEntry, m.bootMagic)
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -310,3 +1276,24 @@ func (m *Multiboot) addTrampoline() (entry uintptr, err error) {
 
 	return addr, nil
 }
+
+// addGeneratedTrampoline adds the trampoline generated for
+// the address it is placed at.
+func (m *Multiboot) addGeneratedTrampoline() (uintptr, error) {
+	base, err := m.mem.FindSpaceIn(trampoline.GeneratedSize, below4G)
+	if err != nil {
+		return 0, err
+	}
+	d, err := trampoline.Generate(base, m.infoAddr, m.kernelEntry, m.bootMagic)
+	if err != nil {
+		return 0, err
+	}
+	addr, err := m.mem.AddKexecSegmentIn(d, below4G)
+	if err != nil {
+		return 0, err
+	}
+	if addr != base {
+		return 0, fmt.Errorf("trampoline generated for %#x is placed at %#x", base, addr)
+	}
+	return addr, nil
+}
@@ -6,11 +6,26 @@ package multiboot
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"debug/elf"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"unsafe"
+
+	"github.com/u-root/u-root/pkg/kexec"
+	"github.com/u-root/u-root/pkg/multiboot/internal/trampoline"
+	"golang.org/x/sys/unix"
 )
 
 func createFile(hdr *Header, offset, size int) (io.Reader, error) {
@@ -32,6 +47,7 @@ const (
 	flagGood        flag = "good"
 	flagUnsupported      = "unsup"
 	flagBad              = "bad"
+	flagZero             = "zero"
 )
 
 func createHeader(fl flag) Header {
@@ -42,6 +58,8 @@ func createHeader(fl flag) Header {
 		checksum = 0xFFFFFFFF - headerMagic - uint32(flags) + 1
 	case flagBad:
 		checksum = 0xDEADBEEF
+	case flagZero:
+		flags = 0
 	case flagUnsupported:
 		flags = 0x0000FFFC
 		checksum = 0xFFFFFFFF - headerMagic - uint32(flags) + 1
@@ -87,7 +105,8 @@ func TestParseHeader(t *testing.T) {
 		{flags: flagGood, offset: 8192 - 4, size: 8192, err: ErrHeaderNotFound},
 		{flags: flagGood, offset: 8192, size: 16384, err: ErrHeaderNotFound},
 		{flags: flagGood, offset: 0, size: 10, err: io.ErrUnexpectedEOF},
-		{flags: flagBad, offset: 0, size: 8192, err: ErrHeaderNotFound},
+		{flags: flagBad, offset: 0, size: 8192, err: ErrBadChecksum{Flags: 0x00000002, Checksum: 0xDEADBEEF}},
+		{flags: flagZero, offset: 0, size: 8192, err: ErrBadChecksum{Uninitialized: true}},
 		{flags: flagUnsupported, offset: 0, size: 8192, err: ErrFlagsNotSupported},
 		{flags: flagGood, offset: 8192 - mandatorySize, size: 8192, err: nil},
 	} {
@@ -118,3 +137,1271 @@ func TestParseHeader(t *testing.T) {
 		})
 	}
 }
+
+// testMemory is a memory map with a RAM region big enough for tests.
+var testMemory = []kexec.TypedAddressRange{
+	{Range: kexec.Range{Start: 0, Size: 0x9fc00}, Type: kexec.RangeRAM},
+	{Range: kexec.Range{Start: 0x100000, Size: 0x7f00000}, Type: kexec.RangeRAM},
+}
+
+func TestHeaderValid(t *testing.T) {
+	noMagic := createHeader(flagGood)
+	noMagic.Magic = 0x2BADB002
+	overflow := createHeader(flagGood)
+	overflow.Flags = 0xFFFFFFFF
+	overflow.Checksum = 0xFFFFFFFF - headerMagic + 2
+
+	for _, test := range []struct {
+		name string
+		hdr  Header
+		ok   bool
+		want error
+	}{
+		{name: "good", hdr: createHeader(flagGood), ok: true},
+		{name: "unsupported flags", hdr: createHeader(flagUnsupported), ok: true},
+		{name: "wraparound", hdr: overflow, ok: true},
+		{name: "bad checksum", hdr: createHeader(flagBad), want: ErrBadChecksum{Flags: 0x00000002, Checksum: 0xDEADBEEF}},
+		{name: "zero", hdr: createHeader(flagZero), want: ErrBadChecksum{Uninitialized: true}},
+		{name: "no magic", hdr: noMagic},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.hdr.Valid()
+			if test.ok != (err == nil) {
+				t.Fatalf("Valid() got error %v, want ok %v", err, test.ok)
+			}
+			if test.want != nil && err != test.want {
+				t.Errorf("Valid() got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestInheritInfo(t *testing.T) {
+	m := New("", "", "", nil)
+	m.mem.Phys = testMemory
+	m.header.Flags = flagHeaderMemoryInfo
+	src := &Info{
+		Flags:      flagInfoMemory | flagInfoBootDev,
+		MemLower:   1,
+		MemUpper:   2,
+		BootDevice: 0x80ffffff,
+		MmapAddr:   0xdead,
+	}
+	m.InheritInfo(src)
+	// Changes made to src after InheritInfo are not passed on.
+	src.MemUpper = 3
+
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&(flagInfoMemory|flagInfoBootDev) != flagInfoMemory|flagInfoBootDev {
+		t.Errorf("Flags got %#x, want memory and boot device flags", m.info.Flags)
+	}
+	if m.info.MemLower != 1 || m.info.MemUpper != 2 {
+		t.Errorf("Memory got lower %d, upper %d, want 1, 2", m.info.MemLower, m.info.MemUpper)
+	}
+	if m.info.BootDevice != 0x80ffffff {
+		t.Errorf("BootDevice got %#x, want %#x", m.info.BootDevice, uint32(0x80ffffff))
+	}
+	// The memory map is not marked valid in the source info.
+	if m.info.MmapAddr == 0xdead {
+		t.Errorf("MmapAddr was inherited without flagInfoMemMap")
+	}
+}
+
+// kernelBase is the physical load address of the kernel
+// created by createKernel.
+const kernelBase = 0x100000
+
+// createKernel returns a minimal 32-bit ELF image with a single
+// PT_LOAD segment containing hdr.
+func createKernel(hdr Header) ([]byte, error) {
+	ehdrSize := binary.Size(elf.Header32{})
+	phdrSize := binary.Size(elf.Prog32{})
+
+	w := bytes.Buffer{}
+	if err := binary.Write(&w, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	payload := w.Bytes()
+	size := ehdrSize + phdrSize + len(payload)
+
+	ehdr := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_386),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     kernelBase + uint32(ehdrSize+phdrSize),
+		Phoff:     uint32(ehdrSize),
+		Ehsize:    uint16(ehdrSize),
+		Phentsize: uint16(phdrSize),
+		Phnum:     1,
+	}
+	copy(ehdr.Ident[:], elf.ELFMAG)
+	ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	phdr := elf.Prog32{
+		Type:   uint32(elf.PT_LOAD),
+		Vaddr:  kernelBase,
+		Paddr:  kernelBase,
+		Filesz: uint32(size),
+		Memsz:  uint32(size),
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Align:  0x1000,
+	}
+
+	b := bytes.Buffer{}
+	for _, v := range []interface{}{ehdr, phdr} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	b.Write(payload)
+	return b.Bytes(), nil
+}
+
+// testTrampoline returns the path of a file containing the trampoline,
+// which is linked into the test binary.
+func testTrampoline(t *testing.T) string {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skipf("trampoline is not supported on %v/%v", runtime.GOOS, runtime.GOARCH)
+	}
+	p, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Cannot find test executable: %v", err)
+	}
+	return p
+}
+
+func TestNewFromFile(t *testing.T) {
+	trampoline := testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// The kernel must not be reopened by path.
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewFromFile(f, "cmdline", trampoline, nil)
+	m.mem.Phys = testMemory
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if want := uintptr(kernelBase + 52 + 32); m.kernelEntry != want {
+		t.Errorf("kernelEntry got %#x, want %#x", m.kernelEntry, want)
+	}
+	if m.EntryPoint == 0 {
+		t.Errorf("EntryPoint is not set")
+	}
+}
+
+func TestLoadGzipKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	compressed := bytes.Buffer{}
+	z := gzip.NewWriter(&compressed)
+	if _, err := z.Write(kernel); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "kernel.gz")
+	if err := ioutil.WriteFile(name, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header, the entry point and the segments
+	// are all read from the decompressed kernel.
+	m := New(name, "cmdline", "", nil, WithMemoryMap(testMemory), WithGeneratedTrampoline())
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if want := uintptr(kernelBase + 52 + 32); m.kernelEntry != want {
+		t.Errorf("kernelEntry got %#x, want %#x", m.kernelEntry, want)
+	}
+	if got := segmentData(t, m.mem.Segments, kernelBase, len(kernel)); !bytes.Equal(got, kernel) {
+		t.Errorf("kernel segment does not hold the decompressed kernel")
+	}
+}
+
+func TestLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	good := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(good, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad")
+	if err := ioutil.WriteFile(bad, make([]byte, 0x2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The configured kernel is replaced by the probed one.
+	m := New(bad, "", "", nil, WithMemoryMap(testMemory), WithGeneratedTrampoline())
+	l := m.Loader()
+	if err := l.Probe(bad); err == nil {
+		t.Errorf("Probe(%v) got nil error, want error", bad)
+	}
+	if err := l.Probe(good); err != nil {
+		t.Fatalf("Probe(%v) error: %v", good, err)
+	}
+	if err := l.Load(); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if len(l.Segments()) == 0 {
+		t.Errorf("Segments() got no segments")
+	}
+}
+
+func TestNewFromBlockDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	// A sparse file simulates a device with the kernel at an offset,
+	// followed by other data.
+	const offset = 64 << 20
+	dev := filepath.Join(dir, "disk")
+	f, err := os.Create(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(kernel, offset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("trailing data"), offset+int64(len(kernel))+0x1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewFromBlockDevice(dev, offset, int64(len(kernel)), "cmdline", nil, WithMemoryMap(testMemory), WithGeneratedTrampoline())
+	if err != nil {
+		t.Fatalf("NewFromBlockDevice() error: %v", err)
+	}
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if want := uintptr(kernelBase + 52 + 32); m.kernelEntry != want {
+		t.Errorf("kernelEntry got %#x, want %#x", m.kernelEntry, want)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close() error: %v", err)
+	}
+	m.Reset()
+	if err := m.Load(false); err == nil {
+		t.Errorf("Load() after Close() got nil error, want error reading the closed device")
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close() error: %v", err)
+	}
+
+	for _, test := range []struct {
+		name           string
+		offset, length int64
+	}{
+		{"beyond end", offset, 1 << 30},
+		{"negative offset", -1, int64(len(kernel))},
+		{"empty", offset, 0},
+	} {
+		if _, err := NewFromBlockDevice(dev, test.offset, test.length, "", nil); err == nil {
+			t.Errorf("NewFromBlockDevice() %s got nil error, want error", test.name)
+		}
+	}
+}
+
+func TestMemoryMapSortedByType(t *testing.T) {
+	m := New("", "", "", nil, WithMemoryMapSortedByType())
+	m.mem.Phys = []kexec.TypedAddressRange{
+		{Range: kexec.Range{Start: 0, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x1000, Size: 0xfff}, Type: kexec.RangeNVS},
+		{Range: kexec.Range{Start: 0x2000, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x3000, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x4000, Size: 0xfff}, Type: kexec.RangeACPI},
+	}
+
+	size := uint32(sizeofMemoryMap) - 4
+	want := memoryMaps{
+		{Size: size, BaseAddr: 0, Length: 0x1000, Type: 1},
+		{Size: size, BaseAddr: 0x2000, Length: 0x2000, Type: 1},
+		{Size: size, BaseAddr: 0x1000, Length: 0x1000, Type: 2},
+		{Size: size, BaseAddr: 0x4000, Length: 0x1000, Type: 3},
+	}
+	if got := m.memoryMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("memoryMap() got %+v, want %+v", got, want)
+	}
+}
+
+// segmentData returns size bytes of a kexec segment
+// stored at the physical address addr.
+func segmentData(t *testing.T, segs []kexec.Segment, addr uintptr, size int) []byte {
+	for _, s := range segs {
+		if addr < s.Phys.Start || addr+uintptr(size) > s.Phys.Start+uintptr(s.Buf.Size) {
+			continue
+		}
+		var data []byte
+		sh := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+		sh.Data = s.Buf.Start + (addr - s.Phys.Start)
+		sh.Len = size
+		sh.Cap = size
+		return data
+	}
+	t.Fatalf("No segment stores %#x bytes at %#x", size, addr)
+	return nil
+}
+
+func TestConfigTableFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	table := []byte("config table")
+	if _, err := f.Write(table); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	m := New("", "", "", nil, WithConfigTableFile(f.Name()))
+	m.mem.Phys = testMemory
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if m.info.Flags&flagInfoConfigTable == 0 {
+		t.Errorf("flagInfoConfigTable is not set")
+	}
+	got := segmentData(t, m.mem.Segments, uintptr(m.info.ConfigTable), len(table))
+	if !bytes.Equal(got, table) {
+		t.Errorf("config table got %q, want %q", got, table)
+	}
+}
+
+func TestInfoBelow4G(t *testing.T) {
+	if unsafe.Sizeof(uintptr(0)) < 8 {
+		t.Skip("cannot address memory above 4GB")
+	}
+	high := uintptr(math.MaxUint32)
+	high++
+
+	m := New("", "", "", nil)
+	m.mem.Phys = []kexec.TypedAddressRange{
+		// Only fits the memory map.
+		{Range: kexec.Range{Start: 0x100000, Size: uint(os.Getpagesize())}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: high, Size: 0x100000}, Type: kexec.RangeRAM},
+	}
+	// The trampoline passes the info address in 32-bit EBX,
+	// so it must not be placed above 4GB.
+	if _, err := m.addInfo(); err != kexec.ErrNotEnoughSpace {
+		t.Fatalf("addInfo() got error %v, want %v", err, kexec.ErrNotEnoughSpace)
+	}
+}
+
+func TestDeterministicLoad(t *testing.T) {
+	trampoline := testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mods := createModules(t, dir, 100, 5000, 20)
+
+	load := func() []kexec.Segment {
+		m := New(name, "cmdline", trampoline, mods, WithMemoryMap(testMemory))
+		if err := m.Load(false); err != nil {
+			t.Fatalf("Load() error: %v", err)
+		}
+		return m.Segments()
+	}
+	a, b := load(), load()
+	if len(a) != len(b) {
+		t.Fatalf("Load() got %d and %d segments", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].Phys != b[i].Phys {
+			t.Errorf("segment %d: got phys %v and %v", i, a[i].Phys, b[i].Phys)
+			continue
+		}
+		da := segmentData(t, a, a[i].Phys.Start, int(a[i].Buf.Size))
+		db := segmentData(t, b, b[i].Phys.Start, int(b[i].Buf.Size))
+		if !bytes.Equal(da, db) {
+			t.Errorf("segment %d at %#x: content differs", i, a[i].Phys.Start)
+		}
+	}
+}
+
+func TestMemoryMapSorted(t *testing.T) {
+	m := New("", "", "", nil)
+	m.mem.Phys = []kexec.TypedAddressRange{
+		{Range: kexec.Range{Start: 0x2000, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x4000, Size: 0xfff}, Type: kexec.RangeReserved},
+		{Range: kexec.Range{Start: 0, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x1000, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x3000, Size: 0xfff}, Type: kexec.RangeRAM},
+	}
+
+	size := uint32(sizeofMemoryMap) - 4
+	want := memoryMaps{
+		{Size: size, BaseAddr: 0, Length: 0x4000, Type: 1},
+		{Size: size, BaseAddr: 0x4000, Length: 0x1000, Type: 2},
+	}
+	if got := m.memoryMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("memoryMap() got %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryMapTypes(t *testing.T) {
+	buf := bytes.Buffer{}
+	m := New("", "", "", nil, WithLogger(log.New(&buf, "", 0)))
+	types := []kexec.RangeType{
+		kexec.RangeRAM,
+		kexec.RangeDefault,
+		kexec.RangeReserved,
+		kexec.RangeACPI,
+		kexec.RangeNVACPI,
+		kexec.RangeUnusable,
+		"Persistent Memory",
+	}
+	for i, typ := range types {
+		m.mem.Phys = append(m.mem.Phys, kexec.TypedAddressRange{
+			Range: kexec.Range{Start: uintptr(i) * 0x2000, Size: 0xfff},
+			Type:  typ,
+		})
+	}
+
+	want := []uint32{1, 2, 2, 3, 4, 5, 2}
+	got := m.memoryMap()
+	for i := range want {
+		if got[i].Type != want[i] {
+			t.Errorf("memory type %q got %d, want %d", types[i], got[i].Type, want[i])
+		}
+	}
+	if logs := buf.String(); strings.Count(logs, "unknown type") != 1 || !strings.Contains(logs, "Persistent Memory") {
+		t.Errorf("logger output %q does not report the unknown type once", logs)
+	}
+}
+
+func TestTrimmedMemoryMap(t *testing.T) {
+	m := New("", "", "", nil, WithTrimmedMemoryMap())
+	m.mem.Phys = []kexec.TypedAddressRange{
+		{Range: kexec.Range{Start: 0, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x1000, Size: 0xfff}, Type: kexec.RangeNVS},
+		{Range: kexec.Range{Start: 0x2000, Size: 0xfff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x3000, Size: 0xfff}, Type: kexec.RangeACPI},
+		{Range: kexec.Range{Start: 0x4000, Size: 0xfffffff}, Type: kexec.RangeNVS},
+	}
+
+	size := uint32(sizeofMemoryMap) - 4
+	want := memoryMaps{
+		{Size: size, BaseAddr: 0, Length: 0x1000, Type: 1},
+		{Size: size, BaseAddr: 0x1000, Length: 0x1000, Type: 2},
+		{Size: size, BaseAddr: 0x2000, Length: 0x1000, Type: 1},
+	}
+	if got := m.memoryMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("memoryMap() got %+v, want %+v", got, want)
+	}
+}
+
+func TestKexecArgs(t *testing.T) {
+	page := uint(os.Getpagesize())
+	m := New("", "", "", nil)
+	m.mem.Segments = []kexec.Segment{
+		kexec.NewSegment([]byte("trampoline"), kexec.Range{Start: 0x200000, Size: 10}),
+		kexec.NewSegment([]byte("kernel"), kexec.Range{Start: 0x100000, Size: 6}),
+	}
+	m.EntryPoint = 0x200000
+
+	entry, flags, segs, err := m.KexecArgs()
+	if err != nil {
+		t.Fatalf("KexecArgs() error: %v", err)
+	}
+	if entry != 0x200000 || flags != 0 {
+		t.Errorf("KexecArgs() got entry %#x, flags %#x, want %#x, 0", entry, flags, 0x200000)
+	}
+	want := []kexec.Range{
+		{Start: 0x100000, Size: page},
+		{Start: 0x200000, Size: page},
+	}
+	if len(segs) != len(want) {
+		t.Fatalf("KexecArgs() got %d segments, want %d", len(segs), len(want))
+	}
+	for i := range want {
+		if segs[i].Phys != want[i] {
+			t.Errorf("segment %d: got phys %+v, want %+v", i, segs[i].Phys, want[i])
+		}
+	}
+	// The staged segments are left untouched.
+	if m.mem.Segments[0].Phys.Start != 0x200000 {
+		t.Errorf("KexecArgs() modified the staged segments")
+	}
+
+	// A crash kernel is loaded with KEXEC_ON_CRASH.
+	m.crashRegion = &kexec.Range{Start: 0x100000, Size: 0x200000}
+	if _, flags, _, err := m.KexecArgs(); err != nil || flags != unix.KEXEC_ON_CRASH {
+		t.Errorf("KexecArgs() with crash kernel region got flags %#x, error %v, want %#x", flags, err, unix.KEXEC_ON_CRASH)
+	}
+}
+
+func TestCmdLineValidator(t *testing.T) {
+	known := map[string]bool{"console": true, "quiet": true}
+	validate := func(cmdLine string) error {
+		for _, arg := range strings.Fields(cmdLine) {
+			if name := strings.SplitN(arg, "=", 2)[0]; !known[name] {
+				return fmt.Errorf("unknown parameter %q", name)
+			}
+		}
+		return nil
+	}
+
+	for _, test := range []struct {
+		cmdLine string
+		wantErr bool
+	}{
+		{cmdLine: "console=ttyS0 quiet"},
+		{cmdLine: "console=ttyS0 qiuet", wantErr: true},
+	} {
+		m := New("", test.cmdLine, "", nil, WithCmdLineValidator(validate))
+		m.mem.Phys = testMemory
+		if _, err := m.addInfo(); (err != nil) != test.wantErr {
+			t.Errorf("addInfo() with %q got error %v, want error %v", test.cmdLine, err, test.wantErr)
+		}
+	}
+}
+
+func TestASCIICmdLines(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		cmdLine string
+		modCmd  string
+		opts    []Option
+		wantErr string
+	}{
+		{name: "ascii", cmdLine: "console=ttyS0", modCmd: "mod arg", opts: []Option{WithASCIICmdLines()}},
+		{name: "non_ascii_default", cmdLine: "name=caf\u00e9", modCmd: "mod caf\u00e9"},
+		{name: "non_ascii_kernel", cmdLine: "name=caf\u00e9", modCmd: "mod", opts: []Option{WithASCIICmdLines()}, wantErr: "non-ASCII byte 0xc3 at offset 8"},
+		{name: "non_ascii_module", cmdLine: "quiet", modCmd: "mod caf\u00e9", opts: []Option{WithASCIICmdLines()}, wantErr: "non-ASCII byte 0xc3 at offset 7"},
+		{name: "nul", cmdLine: "quiet\x00debug", modCmd: "mod", opts: []Option{WithASCIICmdLines()}, wantErr: "NUL byte at offset 5"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mods := []ModuleSpec{{Path: "mod", CmdLine: test.modCmd, Reader: strings.NewReader("module"), Size: 6}}
+			m := NewWithModules("", test.cmdLine, "", mods, test.opts...)
+			m.mem.Phys = testMemory
+			_, err := m.addInfo()
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("addInfo() error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("addInfo() got error %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestReserveKernel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	kernel := &kernelReader{buf: b}
+
+	m := New("", "", "", createModules(t, dir, 10, 10))
+	m.mem.Phys = testMemory
+	if m.header, err = parseHeader(kernel); err != nil {
+		t.Fatalf("parseHeader() error: %v", err)
+	}
+	if err := m.reserveKernel(kernel); err != nil {
+		t.Fatalf("reserveKernel() error: %v", err)
+	}
+	reserved := append([]kexec.Range(nil), m.mem.Reserved...)
+	if len(reserved) == 0 {
+		t.Fatalf("reserveKernel() reserved nothing")
+	}
+
+	// Place info and modules before the kernel segments are loaded.
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	for _, s := range m.mem.Segments {
+		for _, r := range reserved {
+			if s.Phys.Overlaps(r) {
+				t.Errorf("segment %v overlaps kernel range %v", s, r)
+			}
+		}
+	}
+	if err := m.mem.LoadElfSegments(kernel); err != nil {
+		t.Fatalf("LoadElfSegments() error: %v", err)
+	}
+}
+
+// createKernel64 is like createKernel, but creates a 64-bit ELF kernel.
+func createKernel64(hdr Header) ([]byte, error) {
+	ehdrSize := binary.Size(elf.Header64{})
+	phdrSize := binary.Size(elf.Prog64{})
+
+	w := bytes.Buffer{}
+	if err := binary.Write(&w, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	payload := w.Bytes()
+	size := ehdrSize + phdrSize + len(payload)
+
+	ehdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     kernelBase + uint64(ehdrSize+phdrSize),
+		Phoff:     uint64(ehdrSize),
+		Ehsize:    uint16(ehdrSize),
+		Phentsize: uint16(phdrSize),
+		Phnum:     1,
+	}
+	copy(ehdr.Ident[:], elf.ELFMAG)
+	ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	phdr := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Vaddr:  kernelBase,
+		Paddr:  kernelBase,
+		Filesz: uint64(size),
+		Memsz:  uint64(size),
+		Flags:  uint32(elf.PF_R | elf.PF_X),
+		Align:  0x1000,
+	}
+
+	b := bytes.Buffer{}
+	for _, v := range []interface{}{ehdr, phdr} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	b.Write(payload)
+	return b.Bytes(), nil
+}
+
+func TestEmbeddedTrampoline(t *testing.T) {
+	testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name    string
+		create  func(Header) ([]byte, error)
+		machine elf.Machine
+	}{
+		{name: "32bit", create: createKernel, machine: elf.EM_386},
+		{name: "64bit", create: createKernel64, machine: elf.EM_X86_64},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			kernel, err := test.create(createHeader(flagGood))
+			if err != nil {
+				t.Fatalf("Cannot create kernel: %v", err)
+			}
+			name := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			m := New(name, "", "", nil)
+			m.mem.Phys = testMemory
+			if err := m.Load(false); err != nil {
+				t.Fatalf("Load() error: %v", err)
+			}
+			if m.machine != test.machine {
+				t.Errorf("machine got %v, want %v", m.machine, test.machine)
+			}
+
+			want, err := trampoline.SetupEmbedded(test.machine, m.infoAddr, m.kernelEntry, trampoline.DefaultMagic)
+			if err != nil {
+				t.Fatalf("SetupEmbedded() error: %v", err)
+			}
+			if got := segmentData(t, m.mem.Segments, m.EntryPoint, len(want)); !bytes.Equal(got, want) {
+				t.Errorf("trampoline segment is not the embedded trampoline for %v", test.machine)
+			}
+		})
+	}
+}
+
+func TestTrampolineFileDeprecated(t *testing.T) {
+	path := testTrampoline(t)
+
+	buf := bytes.Buffer{}
+	logger := log.New(&buf, "", 0)
+
+	for _, test := range []struct {
+		name       string
+		trampoline string
+		want       bool
+	}{
+		{name: "embedded", trampoline: "", want: false},
+		{name: "file", trampoline: path, want: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			m := New("", "", test.trampoline, nil, WithLogger(logger))
+			m.mem.Phys = testMemory
+			m.machine = elf.EM_386
+			if _, err := m.addTrampoline(); err != nil {
+				t.Fatalf("addTrampoline() error: %v", err)
+			}
+			if got := strings.Contains(buf.String(), "deprecated"); got != test.want {
+				t.Errorf("addTrampoline() logged %q, want deprecation warning %v", buf.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestLoadCtxCanceled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := New(name, "", "", nil)
+	m.mem.Phys = testMemory
+	if err := m.LoadCtx(ctx, false); err != context.Canceled {
+		t.Errorf("LoadCtx() got error %v, want %v", err, context.Canceled)
+	}
+	if len(m.mem.Segments) != 0 {
+		t.Errorf("LoadCtx() added %d segments after cancellation, want none", len(m.mem.Segments))
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing must be logged to the standard logger.
+	std := bytes.Buffer{}
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+
+	buf := bytes.Buffer{}
+	m := New(name, "", "", createModules(t, dir, 10), WithLogger(log.New(&buf, "", 0)))
+	m.mem.Phys = testMemory
+	// Loading fails without a trampoline on other platforms,
+	// but progress is logged anyway.
+	m.Load(false)
+
+	for _, s := range []string{"Parsing file", "Adding module"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("logger output %q does not contain %q", buf.String(), s)
+		}
+	}
+	if std.Len() != 0 {
+		t.Errorf("standard logger got %q, want nothing", std.String())
+	}
+}
+
+func TestNilByteOrder(t *testing.T) {
+	m := New("/nonexistent", "", "", nil, WithByteOrder(nil))
+	if err := m.Load(false); err != ErrUnsupportedEndianness {
+		t.Errorf("Load() got error %v, want %v", err, ErrUnsupportedEndianness)
+	}
+}
+
+func TestLowMemoryUsed(t *testing.T) {
+	if ^uint(0) == math.MaxUint32 {
+		t.Skip("there is no memory above 4GB on 32-bit platforms")
+	}
+	high := uintptr(math.MaxUint32)
+	m := New("", "", "", nil)
+	m.mem.Segments = []kexec.Segment{
+		{Phys: kexec.Range{Start: 0x100000, Size: 0x2000}},
+		{Phys: kexec.Range{Start: 0x200000, Size: 0x1000}},
+		// Only the part below 4GB is counted.
+		{Phys: kexec.Range{Start: high - 0xfff, Size: 0x2000}},
+		{Phys: kexec.Range{Start: high + 0x1001, Size: 0x1000}},
+	}
+	if got, want := m.LowMemoryUsed(), uint(0x4000); got != want {
+		t.Errorf("LowMemoryUsed() got %#x, want %#x", got, want)
+	}
+}
+
+func TestKernelAlignment(t *testing.T) {
+	const align = 2 << 20
+	for _, test := range []struct {
+		name  string
+		paddr uint32
+		want  bool
+	}{
+		{name: "aligned", paddr: align, want: false},
+		{name: "unaligned", paddr: kernelBase, want: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := createKernel(createHeader(flagGood))
+			if err != nil {
+				t.Fatalf("Cannot create kernel: %v", err)
+			}
+			// Patch p_paddr and p_align of the only program header.
+			phoff := binary.Size(elf.Header32{})
+			binary.LittleEndian.PutUint32(b[phoff+12:], test.paddr)
+			binary.LittleEndian.PutUint32(b[phoff+28:], align)
+
+			buf := bytes.Buffer{}
+			m := New("", "", "", nil, WithLogger(log.New(&buf, "", 0)))
+			if err := m.checkKernelAlignment(bytes.NewReader(b)); err != nil {
+				t.Fatalf("checkKernelAlignment() error: %v", err)
+			}
+			if got := strings.Contains(buf.String(), "not aligned"); got != test.want {
+				t.Errorf("checkKernelAlignment() logged %q, want warning %v", buf.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestGeneratedTrampoline(t *testing.T) {
+	m := New("", "", "", nil, WithGeneratedTrampoline())
+	m.mem.Phys = testMemory
+	m.infoAddr = 0x200000
+	m.kernelEntry = kernelBase + 0x40
+	addr, err := m.addTrampoline()
+	if err != nil {
+		t.Fatalf("addTrampoline() error: %v", err)
+	}
+
+	want, err := trampoline.Generate(addr, m.infoAddr, m.kernelEntry, trampoline.DefaultMagic)
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+	if got := segmentData(t, m.mem.Segments, addr, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("trampoline segment is not the trampoline generated for %#x", addr)
+	}
+}
+
+func TestAddr32(t *testing.T) {
+	for _, test := range []struct {
+		addr    uint64
+		size    uint
+		wantErr bool
+	}{
+		{addr: 0x100000, size: 0x1000},
+		{addr: math.MaxUint32, size: 1},
+		{addr: math.MaxUint32, size: 2, wantErr: true},
+		{addr: 1 << 32, size: 0, wantErr: true},
+	} {
+		if test.addr > uint64(^uintptr(0)) {
+			// Addresses above 4GB do not exist on 32-bit platforms.
+			continue
+		}
+		got, err := addr32("test", uintptr(test.addr), test.size)
+		if (err != nil) != test.wantErr {
+			t.Errorf("addr32(%#x, %#x) got error %v, want error %v", test.addr, test.size, err, test.wantErr)
+			continue
+		}
+		if err == nil && uint64(got) != test.addr {
+			t.Errorf("addr32(%#x, %#x) got %#x", test.addr, test.size, got)
+		}
+	}
+}
+
+func TestMemoryMapBelow4G(t *testing.T) {
+	if ^uint(0) == math.MaxUint32 {
+		t.Skip("there is no memory above 4GB on 32-bit platforms")
+	}
+	high := uintptr(math.MaxUint32)
+	high++
+
+	m := New("", "", "", nil)
+	// The only free RAM is above 4GB.
+	m.mem.Phys = []kexec.TypedAddressRange{
+		{Range: kexec.Range{Start: 0, Size: 0x1000}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: high, Size: 0x100000}, Type: kexec.RangeRAM},
+	}
+	m.mem.Segments = append(m.mem.Segments, kexec.NewSegment(make([]byte, 0x1000), kexec.Range{Start: 0, Size: 0x1000}))
+	if _, _, err := m.addMmap(); err == nil {
+		t.Errorf("addMmap() got nil error, want error placing the memory map below 4GB")
+	}
+}
+
+func TestWithBootMagic(t *testing.T) {
+	const magic = 0x1BADB00B
+	m := New("", "", "", nil, WithBootMagic(magic), WithGeneratedTrampoline())
+	m.mem.Phys = testMemory
+	m.infoAddr = 0x200000
+	m.kernelEntry = kernelBase + 0x40
+	addr, err := m.addTrampoline()
+	if err != nil {
+		t.Fatalf("addTrampoline() error: %v", err)
+	}
+
+	want, err := trampoline.Generate(addr, m.infoAddr, m.kernelEntry, magic)
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+	if got := segmentData(t, m.mem.Segments, addr, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("trampoline segment does not set magic %#x", magic)
+	}
+}
+
+func TestMemoryBoundaries(t *testing.T) {
+	// Sizes are one byte short, as in the firmware memory map.
+	ram := func(start, size uint64) kexec.TypedAddressRange {
+		return kexec.TypedAddressRange{Range: kexec.Range{Start: uintptr(start), Size: uint(size)}, Type: kexec.RangeRAM}
+	}
+	reserved := func(start, size uint64) kexec.TypedAddressRange {
+		return kexec.TypedAddressRange{Range: kexec.Range{Start: uintptr(start), Size: uint(size)}, Type: kexec.RangeNVS}
+	}
+	for _, test := range []struct {
+		name         string
+		phys         []kexec.TypedAddressRange
+		lower, upper uint64
+	}{
+		{
+			name:  "640K low, big region from 1M",
+			phys:  []kexec.TypedAddressRange{ram(0, 0x9fbff), reserved(0x9fc00, 0x603ff), ram(0x100000, 0x7fefffff)},
+			lower: 0x9fc00,
+			upper: 0x7ff00000,
+		},
+		{
+			name:  "adjacent regions from 1M",
+			phys:  []kexec.TypedAddressRange{ram(0, 0x9fbff), ram(0x1000000, 0xffffff), ram(0x100000, 0xefffff)},
+			lower: 0x9fc00,
+			upper: 0x1f00000,
+		},
+		{
+			name:  "adjacent regions from the firmware memory map",
+			phys:  []kexec.TypedAddressRange{ram(0, 0x9fbff), ram(0x100000, 0xefffff), ram(0x1000000, 0xffffff)},
+			lower: 0x9fc00,
+			upper: 0x1f00000,
+		},
+		{
+			name:  "hole in upper memory",
+			phys:  []kexec.TypedAddressRange{ram(0, 0x9fbff), ram(0x100000, 0xefffff), ram(0x2000000, 0xffffff)},
+			lower: 0x9fc00,
+			upper: 0xf00000,
+		},
+		{
+			name:  "single region from 0",
+			phys:  []kexec.TypedAddressRange{ram(0, 0x1fffff)},
+			lower: 640 * 1024,
+			upper: 0x100000,
+		},
+		{
+			name:  "upper memory above 4G",
+			phys:  []kexec.TypedAddressRange{ram(0x100000, 1<<33-1)},
+			upper: 1 << 33,
+		},
+		{
+			name:  "no RAM at 1M",
+			phys:  []kexec.TypedAddressRange{ram(0, 0x9fbff), ram(0x200000, 0xfffff)},
+			lower: 0x9fc00,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.upper > uint64(^uint(0)) {
+				t.Skip("there is no memory above 4GB on 32-bit platforms")
+			}
+			m := New("", "", "", nil, WithMemoryMap(test.phys))
+			lower, upper := m.memoryBoundaries()
+			if lower != test.lower || upper != test.upper {
+				t.Errorf("memoryBoundaries() got %#x, %#x, want %#x, %#x", lower, upper, test.lower, test.upper)
+			}
+		})
+	}
+}
+
+func TestUpperMemoryFromMap(t *testing.T) {
+	// memoryBoundaries finds no upper memory, as there is
+	// no RAM at 1M, but the memory map has RAM above it.
+	phys := []kexec.TypedAddressRange{
+		{Range: kexec.Range{Start: 0, Size: 0x9fbff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x200000, Size: 0xfffff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x300000, Size: 0xfffff}, Type: kexec.RangeRAM},
+		{Range: kexec.Range{Start: 0x1000000, Size: 0xffffff}, Type: kexec.RangeRAM},
+	}
+
+	m := New("", "", "", nil, WithMemoryMap(phys))
+	m.header.Flags = flagHeaderMemoryInfo
+	if _, err := m.addInfo(); err == nil {
+		t.Errorf("addInfo() got nil error, want error for zero upper memory")
+	}
+
+	m = New("", "", "", nil, WithMemoryMap(phys), WithUpperMemoryFromMap())
+	m.header.Flags = flagHeaderMemoryInfo
+	if _, err := m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	if want := uint32((0x400000 - 0x100000) >> 10); m.info.MemUpper != want {
+		t.Errorf("MemUpper got %#x, want %#x", m.info.MemUpper, want)
+	}
+}
+
+func TestKexecWithFlags(t *testing.T) {
+	var gotFlags uint64
+	old := kexecLoad
+	defer func() { kexecLoad = old }()
+	kexecLoad = func(entry uintptr, segments []kexec.Segment, flags uint64) error {
+		gotFlags = flags
+		return nil
+	}
+
+	region := kexec.Range{Start: 0x4000000, Size: 0x1000000}
+	m := New("", "cmdline", "", nil, WithCrashKernelRegion(region), WithGeneratedTrampoline(), WithMemoryMap(testMemory))
+	// Load reserves the memory outside of the region
+	// once the memory map is known.
+	m.mem.LimitTo(region)
+	var err error
+	if m.infoAddr, err = m.addInfo(); err != nil {
+		t.Fatalf("addInfo() error: %v", err)
+	}
+	m.kernelEntry = region.Start
+	if m.EntryPoint, err = m.addTrampoline(); err != nil {
+		t.Fatalf("addTrampoline() error: %v", err)
+	}
+	for _, s := range m.mem.Segments {
+		if !region.IsSupersetOf(s.Phys) {
+			t.Errorf("segment %v is outside of the crash kernel region %v", s.Phys, region)
+		}
+	}
+
+	if err := m.KexecWithFlags(unix.KEXEC_ON_CRASH); err != nil {
+		t.Fatalf("KexecWithFlags() error: %v", err)
+	}
+	if gotFlags != unix.KEXEC_ON_CRASH {
+		t.Errorf("kexec_load flags got %#x, want %#x", gotFlags, unix.KEXEC_ON_CRASH)
+	}
+
+	// A segment outside of the region cannot be loaded on crash.
+	m.mem.Segments = append(m.mem.Segments, kexec.NewSegment([]byte("kernel"), kexec.Range{Start: 0x100000, Size: 6}))
+	if err := m.KexecWithFlags(unix.KEXEC_ON_CRASH); err == nil {
+		t.Errorf("KexecWithFlags() with a segment outside of the region got nil error, want error")
+	}
+
+	m = New("", "", "", nil)
+	if err := m.KexecWithFlags(unix.KEXEC_ON_CRASH); err == nil {
+		t.Errorf("KexecWithFlags() without crash kernel region got nil error, want error")
+	}
+}
+
+func TestHeaderString(t *testing.T) {
+	h := Header{
+		mandatory: mandatory{Magic: headerMagic, Flags: flagHeaderPageAlign | flagHeaderAoutKludge, Checksum: 0xe4514ffd},
+		optional:  optional{HeaderAddr: 0x100010, LoadAddr: 0x100000, LoadEndAddr: 0x101000, BSSEndAddr: 0x110000, EntryAddr: 0x100100},
+	}
+	want := "magic 0x1badb002, flags PAGE_ALIGN|AOUT_KLUDGE, checksum 0xe4514ffd, header 0x100010, load 0x100000-0x101000, bss end 0x110000, entry 0x100100"
+	if got := fmt.Sprint(h); got != want {
+		t.Errorf("String() got %q, want %q", got, want)
+	}
+}
+
+func TestMemoryMapString(t *testing.T) {
+	for _, test := range []struct {
+		m    MemoryMap
+		want string
+	}{
+		{MemoryMap{BaseAddr: 0x100000, Length: 0x7f00000, Type: 1}, "[0x100000, 0x8000000) available"},
+		{MemoryMap{BaseAddr: 0xfffc0000, Length: 0x40000, Type: 4}, "[0xfffc0000, 0x100000000) ACPI NVS"},
+		{MemoryMap{BaseAddr: 0, Length: 0x1000, Type: 42}, "[0x0, 0x1000) type 42"},
+	} {
+		if got := fmt.Sprintf("%v", test.m); got != test.want {
+			t.Errorf("String() got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestGetEntryPoint(t *testing.T) {
+	// setMachine overwrites the e_machine field of the ELF header.
+	setMachine := func(b []byte, machine elf.Machine) []byte {
+		binary.LittleEndian.PutUint16(b[18:], uint16(machine))
+		return b
+	}
+	const highEntry = uint64(1)<<32 + 0x1000
+
+	for _, test := range []struct {
+		name    string
+		create  func(Header) ([]byte, error)
+		modify  func([]byte) []byte
+		entry   uint64
+		machine elf.Machine
+		wantErr bool
+	}{
+		{name: "386", create: createKernel, entry: kernelBase + 52 + 32, machine: elf.EM_386},
+		{name: "x86_64", create: createKernel64, entry: kernelBase + 64 + 56, machine: elf.EM_X86_64},
+		{
+			name:   "x86_64 high entry",
+			create: createKernel64,
+			modify: func(b []byte) []byte {
+				binary.LittleEndian.PutUint64(b[24:], highEntry)
+				return b
+			},
+			wantErr: true,
+		},
+		{
+			name:    "32-bit arm",
+			create:  createKernel,
+			modify:  func(b []byte) []byte { return setMachine(b, elf.EM_ARM) },
+			wantErr: true,
+		},
+		{
+			name:    "64-bit arm64",
+			create:  createKernel64,
+			modify:  func(b []byte) []byte { return setMachine(b, elf.EM_AARCH64) },
+			wantErr: true,
+		},
+		{
+			name:    "32-bit x86_64",
+			create:  createKernel,
+			modify:  func(b []byte) []byte { return setMachine(b, elf.EM_X86_64) },
+			wantErr: true,
+		},
+		{
+			name:    "64-bit 386",
+			create:  createKernel64,
+			modify:  func(b []byte) []byte { return setMachine(b, elf.EM_386) },
+			wantErr: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.create(createHeader(flagGood))
+			if err != nil {
+				t.Fatalf("Cannot create kernel: %v", err)
+			}
+			if test.modify != nil {
+				b = test.modify(b)
+			}
+			entry, machine, err := getEntryPoint(bytes.NewReader(b))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("getEntryPoint() got error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if uint64(entry) != test.entry || machine != test.machine {
+				t.Errorf("getEntryPoint() got (%#x, %v), want (%#x, %v)", entry, machine, test.entry, test.machine)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(name, "cmdline", "", createModules(t, dir, 10), WithMemoryMap(testMemory), WithGeneratedTrampoline())
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	first := m.Segments()
+
+	m.Reset()
+	if len(m.Segments()) != 0 || len(m.mem.Reserved) != 0 || m.EntryPoint != 0 || m.infoAddr != 0 || m.kernelEntry != 0 {
+		t.Fatalf("Reset() left segments %v, reserved %v, entry point %#x, info %#x, kernel entry %#x",
+			m.Segments(), m.mem.Reserved, m.EntryPoint, m.infoAddr, m.kernelEntry)
+	}
+	if !reflect.DeepEqual(m.mem.Phys, testMemory) {
+		t.Errorf("Reset() dropped the memory map set with WithMemoryMap")
+	}
+
+	if err := m.Load(false); err != nil {
+		t.Fatalf("Load() after Reset() error: %v", err)
+	}
+	got := m.Segments()
+	if len(got) != len(first) {
+		t.Fatalf("Load() after Reset() got %d segments, want %d", len(got), len(first))
+	}
+	for i := range got {
+		if got[i].Phys != first[i].Phys || !bytes.Equal(got[i].Bytes(), first[i].Bytes()) {
+			t.Errorf("Load() after Reset() got segment %v, want %v", got[i], first[i])
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"encoding/binary"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// Option is a function that configures a Multiboot.
+type Option func(*Multiboot)
+
+// WithInfoAlignment configures the alignment of the total size
+// of the multiboot info block. align must be a power of two.
+//
+// Default is 4 bytes.
+func WithInfoAlignment(align uint) Option {
+	return func(m *Multiboot) {
+		m.infoAlign = align
+	}
+}
+
+// WithMemoryMapSortedByType sorts the memory map passed to the kernel
+// by range type, then by base address, instead of by base address only.
+// Adjacent ranges of the same type are coalesced.
+func WithMemoryMapSortedByType() Option {
+	return func(m *Multiboot) {
+		m.mmapByType = true
+	}
+}
+
+// WithMaxModuleCmdLine limits the length of each module command line
+// to max bytes.
+//
+// Default is no limit.
+func WithMaxModuleCmdLine(max int) Option {
+	return func(m *Multiboot) {
+		m.maxModuleCmdLine = max
+	}
+}
+
+// WithConfigTable passes d as the ROM configuration table to the kernel.
+func WithConfigTable(d []byte) Option {
+	return func(m *Multiboot) {
+		m.configTable = d
+	}
+}
+
+// WithConfigTableFile passes the content of the file at path
+// as the ROM configuration table to the kernel.
+func WithConfigTableFile(path string) Option {
+	return func(m *Multiboot) {
+		m.configTableFile = path
+	}
+}
+
+// WithRSDP passes a copy of the ACPI Root System Description Pointer
+// found at physical address rsdp to the kernel. Multiboot v1 info has
+// no RSDP field, so the copy is passed as the ROM configuration table:
+// Info.ConfigTable points to the RSDP, starting with "RSD PTR ".
+//
+// The RSDT and XSDT referenced by the RSDP are not copied and
+// must stay in place, e.g. in ACPI reclaimable memory.
+// It cannot be used together with WithConfigTable.
+func WithRSDP(rsdp uintptr) Option {
+	return func(m *Multiboot) {
+		m.rsdp = &rsdp
+	}
+}
+
+// WithCmdLinePlaceholder replaces placeholder, e.g. "@INITRD@", in the
+// kernel command line by the load address of module, the path or
+// the file name of a module, once the modules are placed.
+//
+// With a placeholder, the kernel command line may also reference
+// modules with %MODADDR:name% and %MODINDEX:name% like module
+// command lines. Without, it is passed verbatim.
+func WithCmdLinePlaceholder(placeholder, module string) Option {
+	return func(m *Multiboot) {
+		if m.cmdLinePlaceholders == nil {
+			m.cmdLinePlaceholders = make(map[string]string)
+		}
+		m.cmdLinePlaceholders[placeholder] = module
+	}
+}
+
+// WithSeparateInfoStrings places the command line and the bootloader
+// name contiguously in their own segment instead of right after the info.
+//
+// By default the strings follow the info in the same segment.
+func WithSeparateInfoStrings() Option {
+	return func(m *Multiboot) {
+		m.separateInfoStrings = true
+	}
+}
+
+// WithInfoLayout places the listed components contiguously after
+// the multiboot info in the given order, for kernels assuming the
+// layout of another loader. The memory map and the module list are
+// 4-byte aligned, and placed in their own segments if not listed.
+// The command line and the bootloader name are appended in this
+// order if not listed.
+//
+// Default is the command line followed by the bootloader name.
+// It cannot be used with WithSeparateInfoStrings.
+func WithInfoLayout(order ...InfoComponent) Option {
+	return func(m *Multiboot) {
+		m.infoLayout = append([]InfoComponent{}, order...)
+	}
+}
+
+// WithMemoryMapFirst places the memory map right after the multiboot
+// info, at the info address plus the size of the Info structure, for
+// kernels reading the memory map from there instead of Info.MmapAddr.
+// The components listed by WithInfoLayout follow the memory map.
+//
+// It cannot be used with WithSeparateInfoStrings or WithInfoChecksum.
+func WithMemoryMapFirst() Option {
+	return func(m *Multiboot) {
+		m.mmapFirst = true
+	}
+}
+
+// WithInfoChecksum stores a checksum of the multiboot info
+// right after it, for kernels verifying the info they received.
+//
+// The checksum is the CRC32 (IEEE polynomial) of the Info structure,
+// i.e. the first 116 bytes of the info block, with all pointers set.
+// It is stored as a 32-bit value in the kernel byte order at offset 116
+// of the info block. The strings and the vendor info follow it and
+// are not covered.
+func WithInfoChecksum() Option {
+	return func(m *Multiboot) {
+		m.infoChecksum = true
+	}
+}
+
+// WithUpperMemoryFromMap reports upper memory derived from the memory
+// map if there is no RAM at 1 megabyte, instead of failing the load:
+// the end of the first RAM above 1 megabyte minus 1 megabyte.
+//
+// Without it, the load fails if upper memory would be reported as 0
+// while the memory map has RAM above 1 megabyte.
+func WithUpperMemoryFromMap() Option {
+	return func(m *Multiboot) {
+		m.upperMemoryFromMapOK = true
+	}
+}
+
+// WithModuleAlignment aligns the start of each module to align bytes.
+// align must be a power of two.
+//
+// Default is the page size.
+func WithModuleAlignment(align uint) Option {
+	return func(m *Multiboot) {
+		m.moduleAlign = align
+	}
+}
+
+// WithMemoryMap uses phys as the physical memory map
+// instead of reading it from the firmware.
+func WithMemoryMap(phys []kexec.TypedAddressRange) Option {
+	return func(m *Multiboot) {
+		m.mem.Phys = phys
+	}
+}
+
+// WithModuleFloor places modules at or above floor,
+// even if there is free memory below.
+func WithModuleFloor(floor uintptr) Option {
+	return func(m *Multiboot) {
+		m.moduleFloor = floor
+	}
+}
+
+// WithByteOrder marshals multiboot structures in order.
+// Load fails with ErrUnsupportedEndianness if order is nil.
+//
+// Default is the byte order of the host.
+func WithByteOrder(order binary.ByteOrder) Option {
+	return func(m *Multiboot) {
+		m.byteOrder = order
+	}
+}
+
+// WithTrimmedMemoryMap drops all non-RAM ranges above the last RAM range
+// from the memory map passed to the kernel.
+func WithTrimmedMemoryMap() Option {
+	return func(m *Multiboot) {
+		m.trimMmap = true
+	}
+}
+
+// WithModuleNormalization defines how module content
+// is transformed before it is staged.
+//
+// Default is AlwaysDecompress.
+func WithModuleNormalization(norm ModuleNormalization) Option {
+	return func(m *Multiboot) {
+		m.moduleNorm = norm
+	}
+}
+
+// WithModulesAboveKernel places modules above the highest
+// loaded segment of the kernel.
+func WithModulesAboveKernel() Option {
+	return func(m *Multiboot) {
+		m.modulesAboveKernel = true
+	}
+}
+
+// DefaultMaxModuleSize is the default maximum size of a module.
+const DefaultMaxModuleSize = 256 << 20
+
+// WithMaxModuleSize fails the load with ErrTooLarge if a module is
+// larger than max bytes after decompression, guarding against modules,
+// which decompress to more than the available memory.
+// max <= 0 means no limit.
+//
+// Default is DefaultMaxModuleSize.
+func WithMaxModuleSize(max int64) Option {
+	return func(m *Multiboot) {
+		m.maxModuleSize = max
+	}
+}
+
+// WithModuleValidation fails the load if ValidateModules(maxDuplicates)
+// reports an error, e.g. if the kernel file is listed as a module.
+func WithModuleValidation(maxDuplicates int) Option {
+	return func(m *Multiboot) {
+		m.validateModules = true
+		m.maxDuplicateModules = maxDuplicates
+	}
+}
+
+// WithModuleDeduplication places modules with identical content,
+// after normalization, in a single segment shared by all of them.
+// Each module keeps its own command line.
+func WithModuleDeduplication() Option {
+	return func(m *Multiboot) {
+		m.dedupModules = true
+	}
+}
+
+// WithCmdLineValidator validates the kernel command line with v
+// during Load, e.g. to reject parameters unknown to the kernel.
+func WithCmdLineValidator(v func(cmdLine string) error) Option {
+	return func(m *Multiboot) {
+		m.cmdLineValidator = v
+	}
+}
+
+// WithASCIICmdLines requires the kernel and module command lines
+// to be ASCII strings without NUL bytes, as defined by the multiboot
+// spec, and fails loading otherwise.
+//
+// By default command lines are passed verbatim.
+func WithASCIICmdLines() Option {
+	return func(m *Multiboot) {
+		m.asciiCmdLines = true
+	}
+}
+
+// WithBootLoaderName passes name as the bootloader name to the kernel.
+// An empty name keeps the default.
+//
+// Default is "u-root kexec".
+func WithBootLoaderName(name string) Option {
+	return func(m *Multiboot) {
+		if name != "" {
+			m.bootloader = name
+		}
+	}
+}
+
+// WithoutBootLoaderName omits the bootloader name from the multiboot info.
+func WithoutBootLoaderName() Option {
+	return func(m *Multiboot) {
+		m.noBootLoaderName = true
+	}
+}
+
+// WithVideoModeSetter uses s to set the video mode requested by the kernel.
+//
+// By default the requested mode is passed to the kernel unchanged.
+func WithVideoModeSetter(s VideoModeSetter) Option {
+	return func(m *Multiboot) {
+		m.videoModeSetter = s
+	}
+}
+
+// WithBootDevice passes the BIOS drive number and the partition
+// numbers the kernel was loaded from to the kernel.
+// Unused partition numbers are 0xFF.
+//
+// It takes precedence over the boot device passed by InheritInfo.
+func WithBootDevice(drive, part1, part2, part3 uint8) Option {
+	return func(m *Multiboot) {
+		d := packBootDevice(drive, part1, part2, part3)
+		m.bootDevice = &d
+	}
+}
+
+// WithDrives passes the BIOS drives d to the kernel in the drives info.
+func WithDrives(d []Drive) Option {
+	return func(m *Multiboot) {
+		m.drives = d
+	}
+}
+
+// WithAPMTable passes the APM BIOS interface table t to the kernel.
+func WithAPMTable(t APMTable) Option {
+	return func(m *Multiboot) {
+		m.apmTable = &t
+	}
+}
+
+// WithLogger logs the loading progress to l.
+//
+// By default the standard logger of the log package is used.
+func WithLogger(l Logger) Option {
+	return func(m *Multiboot) {
+		m.logger = l
+	}
+}
+
+// WithVendorInfo appends b to the multiboot info after the standard
+// fields and the command line and bootloader name strings,
+// before the final padding.
+//
+// Nothing in the info points to b, the kernel must know its offset:
+// the info address plus the size of the standard fields
+// plus the length of both null-terminated strings.
+func WithVendorInfo(b []byte) Option {
+	return func(m *Multiboot) {
+		m.vendorInfo = b
+	}
+}
+
+// WithoutKernelDecompression parses the kernel as it is stored,
+// even if it looks like compressed data.
+//
+// By default compressed kernels are detected and decompressed.
+func WithoutKernelDecompression() Option {
+	return func(m *Multiboot) {
+		m.rawKernel = true
+	}
+}
+
+// WithGeneratedTrampoline uses amd64 trampoline code generated in Go
+// instead of the trampoline embedded into the running binary,
+// if no trampoline file is given.
+//
+// Without it, the embedded trampoline is used if no trampoline
+// file is given, so existing loads boot with the same code.
+func WithGeneratedTrampoline() Option {
+	return func(m *Multiboot) {
+		m.generatedTrampoline = true
+	}
+}
+
+// WithAoutSymbols passes the a.out symbol table symtab and
+// the string table strtab to a kernel loaded using the a.out kludge.
+// strtab must not include the leading size field.
+//
+// They are ignored for ELF kernels, which get their section headers.
+func WithAoutSymbols(symtab, strtab []byte) Option {
+	return func(m *Multiboot) {
+		m.aoutSymtab = symtab
+		m.aoutStrtab = strtab
+	}
+}
+
+// WithSymbolFile passes the section headers and the symbol and
+// string tables of the ELF file at path, e.g. created by
+// objcopy --only-keep-debug, instead of those of the kernel.
+// Use it to boot a stripped kernel with its symbols.
+//
+// It is ignored for a.out kludge kernels.
+func WithSymbolFile(path string) Option {
+	return func(m *Multiboot) {
+		m.symbolFile = path
+	}
+}
+
+// WithBootMagic sets the magic value the trampoline
+// stores in EAX before jumping to the kernel,
+// for kernels that expect a nonstandard value.
+//
+// Default is 0x2BADB002 defined by the multiboot v1 spec.
+func WithBootMagic(magic uint32) Option {
+	return func(m *Multiboot) {
+		m.bootMagic = magic
+	}
+}
+
+// WithCrashKernelRegion allocates all segments placed by the loader
+// within r, the memory reserved for the crash kernel, e.g. by the
+// crashkernel= command line parameter. Use it to load the image with
+// KexecWithFlags(unix.KEXEC_ON_CRASH).
+//
+// The kernel itself must be linked to load within r.
+func WithCrashKernelRegion(r kexec.Range) Option {
+	return func(m *Multiboot) {
+		m.crashRegion = &r
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/u-root/u-root/pkg/kexec"
+)
+
+// ErrNoPlan is returned by Commit if there is no plan to commit.
+var ErrNoPlan = errors.New("multiboot: no plan to commit")
+
+// Plan is like LoadCtx, but it does not stage the segments.
+// It returns the planned segments, which can be inspected
+// and are staged by Commit.
+//
+// Plan reads all the kernel and module bytes, like LoadCtx. Until the
+// plan is committed, m describes the load staged before Plan: Segments,
+// LowMemoryUsed, KexecArgs, Description and the other accessors do not
+// reflect the planned load.
+//
+// Plan does not set the video mode, the planned info reports the
+// requested mode instead. The mode is set by Commit.
+func (m *Multiboot) Plan(ctx context.Context, debug bool) ([]kexec.Segment, error) {
+	staged := *m
+	staged.plan = nil
+	// Segments and reserved ranges appended while planning
+	// must not share the arrays of the staged ones.
+	m.mem.Segments = append([]kexec.Segment(nil), m.mem.Segments...)
+	m.mem.Reserved = append([]kexec.Range(nil), m.mem.Reserved...)
+	m.videoModeSetter = nil
+
+	err := m.LoadCtx(ctx, debug)
+	planned := *m
+	*m = staged
+	if err != nil {
+		return nil, err
+	}
+	planned.videoModeSetter = staged.videoModeSetter
+	m.plan = &planned
+	return planned.mem.Segments[len(staged.mem.Segments):], nil
+}
+
+// Commit sets the video mode requested by the kernel, stages the
+// segments planned by the last Plan and makes the planned load
+// the current one.
+func (m *Multiboot) Commit() error {
+	p := m.plan
+	if p == nil {
+		return ErrNoPlan
+	}
+	if err := p.setVideoMode(); err != nil {
+		return err
+	}
+	*m = *p
+	m.plan = nil
+	return nil
+}
+
+// setVideoMode sets the video mode requested by the kernel
+// and updates the staged info with the resulting framebuffer.
+func (m *Multiboot) setVideoMode() error {
+	if m.header.Flags&flagHeaderMultibootVideoMode == 0 || m.videoModeSetter == nil {
+		return nil
+	}
+	fb, err := m.videoModeSetter.SetVideoMode(m.header.requestedVideoMode())
+	if err != nil {
+		return fmt.Errorf("cannot set video mode: %v", err)
+	}
+	info := m.info
+	info.setFramebuffer(fb)
+	var buf bytes.Buffer
+	if err := writeInfo(&buf, info, m.byteOrder, m.infoChecksum); err != nil {
+		return err
+	}
+	copy(m.infoData, buf.Bytes())
+	m.info = info
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanCommit(t *testing.T) {
+	trampoline := testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(name, "", trampoline, createModules(t, dir, 10), WithMemoryMap(testMemory))
+	if err := m.Commit(); err != ErrNoPlan {
+		t.Errorf("Commit() without plan got error %v, want %v", err, ErrNoPlan)
+	}
+
+	plan, err := m.Plan(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Plan() error: %v", err)
+	}
+	if len(plan) == 0 {
+		t.Fatalf("Plan() got no segments")
+	}
+	if got := m.Segments(); len(got) != 0 {
+		t.Errorf("Segments() before Commit() got %d segments, want none", len(got))
+	}
+	// The planned load is not visible before Commit.
+	if m.EntryPoint != 0 || m.infoAddr != 0 || len(m.Modules()) != 0 || m.info != (Info{}) {
+		t.Errorf("Plan() changed the load state before Commit(): entry %#x, info %#x, %d modules", m.EntryPoint, m.infoAddr, len(m.Modules()))
+	}
+
+	if err := m.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	if got := m.Segments(); !reflect.DeepEqual(got, plan) {
+		t.Errorf("Segments() after Commit() got %v, want %v", got, plan)
+	}
+	if m.EntryPoint == 0 || len(m.Modules()) != 1 {
+		t.Errorf("Commit() got entry %#x, %d modules, want the planned load", m.EntryPoint, len(m.Modules()))
+	}
+	if err := m.Commit(); err != ErrNoPlan {
+		t.Errorf("second Commit() got error %v, want %v", err, ErrNoPlan)
+	}
+}
+
+func TestPlanVideoMode(t *testing.T) {
+	trampoline := testTrampoline(t)
+	dir, err := ioutil.TempDir("", "multiboot")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hdr := createHeader(flagGood)
+	hdr.Flags |= flagHeaderMultibootVideoMode
+	hdr.Checksum = -(headerMagic + uint32(hdr.Flags))
+	hdr.ModeType, hdr.Width, hdr.Height, hdr.Depth = ModeTypeLinear, 800, 600, 24
+	kernel, err := createKernel(hdr)
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	setter := &fakeVideoModeSetter{}
+	m := New(name, "", trampoline, nil, WithMemoryMap(testMemory), WithVideoModeSetter(setter), WithInfoChecksum())
+	if _, err := m.Plan(context.Background(), false); err != nil {
+		t.Fatalf("Plan() error: %v", err)
+	}
+	if setter.req != (VideoMode{}) {
+		t.Errorf("Plan() set video mode %+v, want no call", setter.req)
+	}
+	if got := m.plan.info.FramebufferWidth; got != 800 {
+		t.Errorf("planned framebuffer width got %d, want the requested 800", got)
+	}
+
+	if err := m.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	if want := hdr.requestedVideoMode(); setter.req != want {
+		t.Errorf("Commit() set video mode %+v, want %+v", setter.req, want)
+	}
+	if m.info.FramebufferAddr != 0xfd000000 || m.info.FramebufferWidth != 1024 {
+		t.Errorf("info after Commit() got framebuffer %#x width %d, want the mode set", m.info.FramebufferAddr, m.info.FramebufferWidth)
+	}
+	var want bytes.Buffer
+	if err := writeInfo(&want, m.info, m.byteOrder, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := segmentData(t, m.Segments(), m.infoAddr, want.Len()); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("staged info after Commit() does not match the info with the mode set")
+	}
+}
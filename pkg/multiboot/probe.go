@@ -0,0 +1,112 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"debug/elf"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/u-root/u-root/pkg/ubinary"
+)
+
+// ErrNotELF is returned when a multiboot kernel is not an ELF file.
+var ErrNotELF = errors.New("multiboot kernel is not an ELF file")
+
+// ProbeReason classifies the reason a Probe failed.
+type ProbeReason int
+
+const (
+	// ReasonNone means there was no error.
+	ReasonNone ProbeReason = iota
+	// ReasonUnknown means the error could not be classified.
+	ReasonUnknown
+	// ReasonIO means the file could not be read.
+	ReasonIO
+	// ReasonNoHeader means no multiboot header was found.
+	ReasonNoHeader
+	// ReasonBadChecksum means the multiboot header checksum is not valid.
+	ReasonBadChecksum
+	// ReasonUnsupportedFlags means the multiboot header requests
+	// features which are not supported.
+	ReasonUnsupportedFlags
+	// ReasonNotELF means the kernel is not an ELF file.
+	ReasonNotELF
+)
+
+var probeReasons = map[ProbeReason]string{
+	ReasonNone:             "none",
+	ReasonUnknown:          "unknown",
+	ReasonIO:               "I/O error",
+	ReasonNoHeader:         "no header",
+	ReasonBadChecksum:      "bad checksum",
+	ReasonUnsupportedFlags: "unsupported flags",
+	ReasonNotELF:           "not ELF",
+}
+
+func (r ProbeReason) String() string {
+	if s, ok := probeReasons[r]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// ProbeFailure returns the reason of an error returned by Probe.
+func ProbeFailure(err error) ProbeReason {
+	if err == nil {
+		return ReasonNone
+	}
+	switch err.(type) {
+	case *os.PathError:
+		return ReasonIO
+	case ErrBadChecksum:
+		return ReasonBadChecksum
+	case *elf.FormatError:
+		return ReasonNotELF
+	}
+	switch err {
+	case ErrHeaderNotFound, io.EOF, io.ErrUnexpectedEOF:
+		return ReasonNoHeader
+	case ErrFlagsNotSupported:
+		return ReasonUnsupportedFlags
+	case ErrNotELF:
+		return ReasonNotELF
+	}
+	return ReasonUnknown
+}
+
+// QuickVersion returns 1 for multiboot v1 and 2 for multiboot2 kernels.
+//
+// It only looks for the header magic numbers, without decoding
+// the header or validating its checksum. If both magic numbers
+// are present, 1 is returned as Load prefers v1 headers.
+func QuickVersion(r io.Reader) (int, error) {
+	buf := make([]byte, header2Search)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	buf = buf[:n]
+
+	magicAt := func(magic uint32, limit, align int) bool {
+		if limit > len(buf) {
+			limit = len(buf)
+		}
+		for off := 0; off+4 <= limit; off += align {
+			if ubinary.NativeEndian.Uint32(buf[off:]) == magic {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case magicAt(headerMagic, 8192, 4):
+		return 1, nil
+	case magicAt(header2Magic, header2Search, 8):
+		return 2, nil
+	}
+	return 0, ErrHeaderNotFound
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProbeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rawHeader := func(fl flag) []byte {
+		hdr := createHeader(fl)
+		w := bytes.Buffer{}
+		if err := binary.Write(&w, binary.LittleEndian, hdr); err != nil {
+			t.Fatal(err)
+		}
+		return w.Bytes()
+	}
+	kernel, err := createKernel(createHeader(flagGood))
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want ProbeReason
+	}{
+		{name: "ok", data: kernel, want: ReasonNone},
+		{name: "io", want: ReasonIO},
+		{name: "no_header", data: bytes.Repeat([]byte{0}, 8192), want: ReasonNoHeader},
+		{name: "bad_checksum", data: rawHeader(flagBad), want: ReasonBadChecksum},
+		{name: "unsupported_flags", data: rawHeader(flagUnsupported), want: ReasonUnsupportedFlags},
+		{name: "not_elf", data: rawHeader(flagGood), want: ReasonNotELF},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			name := filepath.Join(dir, test.name)
+			if test.data != nil {
+				if err := ioutil.WriteFile(name, test.data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := Probe(name)
+			if got := ProbeFailure(err); got != test.want {
+				t.Errorf("ProbeFailure(%v) got %v, want %v", err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuickVersion(t *testing.T) {
+	magic := func(off int, m uint32) []byte {
+		b := make([]byte, 16384)
+		binary.LittleEndian.PutUint32(b[off:], m)
+		return b
+	}
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{name: "v1", data: magic(4, headerMagic), want: 1},
+		{name: "v2", data: magic(8, header2Magic), want: 2},
+		// The v2 magic must be 64-bit aligned.
+		{name: "v2_unaligned", data: magic(12, header2Magic), wantErr: true},
+		// The v1 header must be within the first 8192 bytes.
+		{name: "v1_too_far", data: magic(8192, headerMagic), wantErr: true},
+		{name: "none", data: make([]byte, 100), wantErr: true},
+		{name: "empty", data: nil, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := QuickVersion(bytes.NewReader(test.data))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("QuickVersion() got error %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("QuickVersion() got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProbeHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "probe")
+	if err != nil {
+		t.Fatalf("Cannot create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := createHeader(flagGood)
+	kernel, err := createKernel(want)
+	if err != nil {
+		t.Fatalf("Cannot create kernel: %v", err)
+	}
+	name := filepath.Join(dir, "kernel")
+	if err := ioutil.WriteFile(name, kernel, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ProbeHeader(name)
+	if err != nil {
+		t.Fatalf("ProbeHeader() error: %v", err)
+	}
+	if got != want {
+		t.Errorf("ProbeHeader() got %+v, want %+v", got, want)
+	}
+}
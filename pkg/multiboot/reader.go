@@ -5,11 +5,15 @@
 package multiboot
 
 import (
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 )
 
 type kernelReader struct {
@@ -35,13 +39,117 @@ func (kr *kernelReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
-func readGzip(r io.Reader) ([]byte, error) {
-	z, err := gzip.NewReader(r)
+// gzipMagic is the magic number of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// errNotGzip is returned by readGzip if the data is not gzip compressed.
+var errNotGzip = errors.New("gzip: invalid header")
+
+// readGzip decompresses gzip compressed data.
+// It returns errNotGzip if r does not start with the gzip magic,
+// and any other error if the data is corrupt.
+func readGzip(r io.Reader, max int64) ([]byte, error) {
+	magic := make([]byte, len(gzipMagic))
+	if _, err := io.ReadFull(r, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errNotGzip
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return nil, errNotGzip
+	}
+	z, err := gzip.NewReader(io.MultiReader(bytes.NewReader(magic), r))
 	if err != nil {
 		return nil, err
 	}
 	defer z.Close()
-	return ioutil.ReadAll(z)
+	return readAllLimit(z, max)
+}
+
+// bzip2Magic is the magic number of bzip2 compressed data.
+var bzip2Magic = []byte("BZh")
+
+// errNotBzip2 is returned by readBzip2 if the data is not bzip2 compressed.
+var errNotBzip2 = errors.New("bzip2: invalid header")
+
+// readBzip2 decompresses bzip2 compressed data.
+// It returns errNotBzip2 if r does not start with the bzip2 magic
+// followed by the block size digit, and any other error if the
+// data is corrupt.
+func readBzip2(r io.Reader, max int64) ([]byte, error) {
+	// bzip2.NewReader does not check the header,
+	// so check the magic number first.
+	magic := make([]byte, len(bzip2Magic)+1)
+	if _, err := io.ReadFull(r, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errNotBzip2
+	} else if err != nil {
+		return nil, err
+	}
+	if level := magic[len(bzip2Magic)]; !bytes.HasPrefix(magic, bzip2Magic) || level < '1' || level > '9' {
+		return nil, errNotBzip2
+	}
+	return readAllLimit(bzip2.NewReader(io.MultiReader(bytes.NewReader(magic), r)), max)
+}
+
+// xzMagic is the magic number of xz compressed data.
+var xzMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+
+// errNotXz is returned by readXz if the data is not xz compressed.
+var errNotXz = errors.New("xz: invalid header")
+
+// readXz decompresses xz compressed data using xzcat,
+// as there is no xz decompressor in the standard library.
+// It returns errNotXz if r does not start with the xz magic,
+// and any other error if the data is corrupt or xzcat fails.
+func readXz(r io.Reader, max int64) ([]byte, error) {
+	magic := make([]byte, len(xzMagic))
+	if _, err := io.ReadFull(r, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errNotXz
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, xzMagic) {
+		return nil, errNotXz
+	}
+	c := exec.Command("xzcat")
+	c.Stdin = io.MultiReader(bytes.NewReader(magic), r)
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("xzcat: %v", err)
+	}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("xzcat: %v", err)
+	}
+	b, err := readAllLimit(out, max)
+	if err != nil {
+		c.Process.Kill()
+		c.Wait()
+		return nil, err
+	}
+	if err := c.Wait(); err != nil {
+		return nil, fmt.Errorf("xzcat: %v", err)
+	}
+	return b, nil
+}
+
+// ErrTooLarge is returned if a module is larger than
+// the maximum module size after decompression.
+var ErrTooLarge = errors.New("content exceeds size limit")
+
+// readAllLimit reads r until EOF. It fails with ErrTooLarge
+// if r has more than max bytes. max <= 0 means no limit.
+func readAllLimit(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, ErrTooLarge
+	}
+	return b, nil
 }
 
 func readFile(name string) ([]byte, error) {
@@ -50,13 +158,73 @@ func readFile(name string) ([]byte, error) {
 		return nil, err
 	}
 	defer f.Close()
-	b, err := readGzip(f)
-	if err == nil {
-		return b, err
-	}
+	return readSeeker(f)
+}
+
+// readSeeker reads the whole content of f from its beginning,
+// decompressing it if needed.
+func readSeeker(f io.ReadSeeker) ([]byte, error) {
+	return readSeekerLimit(f, 0)
+}
+
+// readSeekerLimit is like readSeeker, but fails if the
+// decompressed content is larger than max bytes.
+// max <= 0 means no limit.
+func readSeekerLimit(f io.ReadSeeker, max int64) ([]byte, error) {
+	b, _, err := decompress(f, max)
+	return b, err
+}
+
+// Compression formats of modules, see ModuleReport.
+const (
+	FormatRaw   = "raw"
+	FormatGzip  = "gzip"
+	FormatBzip2 = "bzip2"
+	FormatXz    = "xz"
+)
+
+// decompress is like readSeekerLimit, but also returns
+// the detected compression format.
+func decompress(f io.ReadSeeker, max int64) ([]byte, string, error) {
 	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("cannot rewind file: %v", err)
+		return nil, "", fmt.Errorf("cannot rewind file: %v", err)
+	}
+	// Corrupt compressed data is an error rather than raw data,
+	// as the magic numbers are unlikely to appear by chance.
+	for _, d := range []struct {
+		format   string
+		read     func(io.Reader, int64) ([]byte, error)
+		notFound error
+	}{
+		{FormatGzip, readGzip, errNotGzip},
+		{FormatBzip2, readBzip2, errNotBzip2},
+		{FormatXz, readXz, errNotXz},
+	} {
+		b, err := d.read(f, max)
+		if err == nil {
+			return b, d.format, nil
+		}
+		if err != d.notFound {
+			return nil, "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, "", fmt.Errorf("cannot rewind file: %v", err)
+		}
 	}
 
-	return ioutil.ReadAll(f)
+	b, err := readAllLimit(f, max)
+	return b, FormatRaw, err
+}
+
+// detectFormat returns the compression format of b by its magic number.
+func detectFormat(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return FormatGzip
+	case bytes.HasPrefix(b, bzip2Magic) && len(b) > len(bzip2Magic) && b[len(bzip2Magic)] >= '1' && b[len(bzip2Magic)] <= '9':
+		return FormatBzip2
+	case bytes.HasPrefix(b, xzMagic):
+		return FormatXz
+	}
+	return FormatRaw
 }
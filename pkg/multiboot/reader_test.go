@@ -0,0 +1,134 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os/exec"
+	"testing"
+)
+
+// bzip2Content is "module content\n" compressed with bzip2.
+var bzip2Content = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x31, 0x3f,
+	0xc0, 0xb8, 0x00, 0x00, 0x03, 0xd1, 0x80, 0x00, 0x10, 0x40, 0x00, 0x0e,
+	0x07, 0x86, 0x00, 0x20, 0x00, 0x22, 0x01, 0xa1, 0x90, 0x80, 0x69, 0xa6,
+	0x82, 0x28, 0xed, 0xac, 0xc0, 0x79, 0x32, 0xf1, 0x77, 0x24, 0x53, 0x85,
+	0x09, 0x03, 0x13, 0xfc, 0x0b, 0x80,
+}
+
+// xzContent is "module content\n" compressed with xz.
+var xzContent = []byte{
+	0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00, 0x00, 0x04, 0xe6, 0xd6, 0xb4, 0x46,
+	0x04, 0xc0, 0x13, 0x0f, 0x21, 0x01, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xa7, 0x69, 0xdd, 0xfe, 0x01, 0x00, 0x0e, 0x6d,
+	0x6f, 0x64, 0x75, 0x6c, 0x65, 0x20, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e,
+	0x74, 0x0a, 0x00, 0x00, 0x8f, 0x68, 0x46, 0xce, 0x54, 0xca, 0x15, 0x9a,
+	0x00, 0x01, 0x2f, 0x0f, 0xd7, 0x90, 0x25, 0xa2, 0x1f, 0xb6, 0xf3, 0x7d,
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x04, 0x59, 0x5a,
+}
+
+func TestReadXz(t *testing.T) {
+	if _, err := exec.LookPath("xzcat"); err != nil {
+		t.Skipf("xzcat is not available: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{name: "xz", data: xzContent, want: []byte("module content\n")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readSeeker(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("readSeeker() error: %v", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("readSeeker() got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSeeker(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		want []byte
+	}{
+		{name: "raw", data: []byte("module content\n"), want: []byte("module content\n")},
+		{name: "bzip2", data: bzip2Content, want: []byte("module content\n")},
+		// Data starting with "BZh" without a block size is not bzip2 compressed.
+		{name: "raw_bzip2_magic", data: []byte("BZh not bzip2"), want: []byte("BZh not bzip2")},
+		{name: "short", data: []byte("BZ"), want: []byte("BZ")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readSeeker(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatalf("readSeeker() error: %v", err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("readSeeker() got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadSeekerGzip(t *testing.T) {
+	buf := bytes.Buffer{}
+	z := gzip.NewWriter(&buf)
+	if _, err := z.Write([]byte("module content\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	compressed := buf.Bytes()
+
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "gzip", data: compressed, want: []byte("module content\n")},
+		{name: "short", data: []byte{0x1f}, want: []byte{0x1f}},
+		{name: "truncated", data: compressed[:len(compressed)-10], wantErr: true},
+		{name: "bad header", data: append(append([]byte{}, gzipMagic...), "not gzip"...), wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readSeeker(bytes.NewReader(test.data))
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("readSeeker() got error %v, want error %t", err, test.wantErr)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("readSeeker() got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestReadSeekerCorrupt checks that corrupt compressed data is an error
+// rather than raw data. It does not depend on xzcat, as a missing xzcat
+// is an error as well.
+func TestReadSeekerCorrupt(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{name: "xz", data: append(append([]byte{}, xzMagic...), "not xz"...)},
+		{name: "truncated xz", data: xzContent[:len(xzContent)-10]},
+		{name: "bzip2", data: []byte("BZh9 not bzip2")},
+		{name: "truncated bzip2", data: bzip2Content[:len(bzip2Content)-10]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := readSeeker(bytes.NewReader(test.data)); err == nil {
+				t.Errorf("readSeeker() got %q, want error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// devMem is the file the RSDP is read from.
+var devMem = "/dev/mem"
+
+const (
+	rsdpSignature = "RSD PTR "
+	// sizeofRSDPv1 is the size of an ACPI 1.0 RSDP,
+	// which has no length field.
+	sizeofRSDPv1 = 20
+	// maxRSDPSize limits the length field of an ACPI 2.0+ RSDP,
+	// which is 36 bytes for all versions defined so far.
+	maxRSDPSize = 1024
+)
+
+// readRSDP reads the ACPI Root System Description Pointer
+// from physical address addr.
+func readRSDP(addr uintptr) ([]byte, error) {
+	f, err := os.Open(devMem)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, sizeofRSDPv1)
+	if _, err := f.ReadAt(b, int64(addr)); err != nil {
+		return nil, fmt.Errorf("cannot read RSDP at %#x: %v", addr, err)
+	}
+	if !bytes.HasPrefix(b, []byte(rsdpSignature)) {
+		return nil, fmt.Errorf("no RSDP signature at %#x", addr)
+	}
+
+	// Revision 0 is ACPI 1.0, later revisions have a length field.
+	if revision := b[15]; revision != 0 {
+		var length uint32
+		if err := binary.Read(io.NewSectionReader(f, int64(addr)+20, 4), binary.LittleEndian, &length); err != nil {
+			return nil, fmt.Errorf("cannot read RSDP length at %#x: %v", addr, err)
+		}
+		if length < sizeofRSDPv1 || length > maxRSDPSize {
+			return nil, fmt.Errorf("invalid RSDP length %d", length)
+		}
+		b = make([]byte, length)
+		if _, err := f.ReadAt(b, int64(addr)); err != nil {
+			return nil, fmt.Errorf("cannot read RSDP at %#x: %v", addr, err)
+		}
+	}
+	if acpiChecksum(b[:sizeofRSDPv1]) != 0 || acpiChecksum(b) != 0 {
+		return nil, fmt.Errorf("invalid RSDP checksum at %#x", addr)
+	}
+	return b, nil
+}
+
+// acpiChecksum returns the byte sum of b, which is zero for valid ACPI tables.
+func acpiChecksum(b []byte) uint8 {
+	var sum uint8
+	for _, c := range b {
+		sum += c
+	}
+	return sum
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// createRSDP returns an RSDP of the given revision with valid checksums.
+func createRSDP(revision uint8) []byte {
+	b := make([]byte, sizeofRSDPv1, 36)
+	copy(b, rsdpSignature)
+	copy(b[9:15], "UROOT ")
+	b[15] = revision
+	binary.LittleEndian.PutUint32(b[16:], 0x7fe1000)
+	if revision != 0 {
+		b = b[:36]
+		binary.LittleEndian.PutUint32(b[20:], 36)
+		binary.LittleEndian.PutUint64(b[24:], 0x7fe2000)
+	}
+	b[8] = -acpiChecksum(b[:sizeofRSDPv1])
+	if revision != 0 {
+		b[32] = -acpiChecksum(b)
+	}
+	return b
+}
+
+func TestWithRSDP(t *testing.T) {
+	f, err := ioutil.TempFile("", "mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer func(old string) { devMem = old }(devMem)
+	devMem = f.Name()
+
+	const addr = 0xf0000
+	bad := createRSDP(2)
+	bad[8]++
+
+	for _, test := range []struct {
+		name    string
+		rsdp    []byte
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "ACPI 1.0", rsdp: createRSDP(0)},
+		{name: "ACPI 2.0", rsdp: createRSDP(2)},
+		{name: "bad checksum", rsdp: bad, wantErr: true},
+		{name: "no signature", rsdp: make([]byte, 36), wantErr: true},
+		{name: "config table", rsdp: createRSDP(0), opts: []Option{WithConfigTable([]byte{1})}, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := f.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt(test.rsdp, addr); err != nil {
+				t.Fatal(err)
+			}
+
+			m := New("", "", "", nil, append(test.opts, WithRSDP(addr))...)
+			m.mem.Phys = testMemory
+			_, err := m.addInfo()
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("addInfo() got error %v, want error %t", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if m.info.Flags&flagInfoConfigTable == 0 {
+				t.Fatalf("Flags got %#x, want config table flag set", m.info.Flags)
+			}
+			if got := segmentData(t, m.mem.Segments, uintptr(m.info.ConfigTable), len(test.rsdp)); !bytes.Equal(got, test.rsdp) {
+				t.Errorf("config table got %#v, want RSDP %#v", got, test.rsdp)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import "fmt"
+
+// Video mode types requested in the multiboot header.
+const (
+	ModeTypeLinear = 0
+	ModeTypeText   = 1
+)
+
+// Framebuffer types reported in the multiboot info.
+const (
+	FramebufferIndexed = 0
+	FramebufferRGB     = 1
+	FramebufferText    = 2
+)
+
+// VideoMode is a video mode requested by the kernel.
+// Zero fields mean the kernel has no preference.
+type VideoMode struct {
+	// Type is ModeTypeLinear or ModeTypeText.
+	Type   uint32
+	Width  uint32
+	Height uint32
+	// Depth is the number of bits per pixel in a graphics mode.
+	Depth uint32
+}
+
+// Framebuffer describes the framebuffer of the video mode
+// passed to the kernel.
+type Framebuffer struct {
+	Addr   uint64
+	Pitch  uint32
+	Width  uint32
+	Height uint32
+	BPP    uint8
+	// Type is FramebufferIndexed, FramebufferRGB or FramebufferText.
+	Type uint8
+}
+
+// VideoModeSetter sets a video mode as close as possible
+// to the mode requested by the kernel.
+type VideoModeSetter interface {
+	SetVideoMode(req VideoMode) (Framebuffer, error)
+}
+
+// requestedVideoMode returns the video mode requested in the header.
+func (h Header) requestedVideoMode() VideoMode {
+	return VideoMode{
+		Type:   h.ModeType,
+		Width:  h.Width,
+		Height: h.Height,
+		Depth:  h.Depth,
+	}
+}
+
+// Bounds of a video mode requested by the kernel.
+const (
+	maxVideoWidth  = 16384
+	maxVideoHeight = 16384
+	maxVideoDepth  = 32
+)
+
+// validate checks that the fields of v are within reasonable bounds.
+// Zero width, height and depth mean no preference and are valid.
+func (v VideoMode) validate() error {
+	if v.Type != ModeTypeLinear && v.Type != ModeTypeText {
+		return fmt.Errorf("unknown video mode type %d", v.Type)
+	}
+	if v.Width > maxVideoWidth {
+		return fmt.Errorf("video mode width %d exceeds %d", v.Width, maxVideoWidth)
+	}
+	if v.Height > maxVideoHeight {
+		return fmt.Errorf("video mode height %d exceeds %d", v.Height, maxVideoHeight)
+	}
+	if v.Type == ModeTypeLinear && v.Depth > maxVideoDepth {
+		return fmt.Errorf("video mode depth %d exceeds %d", v.Depth, maxVideoDepth)
+	}
+	return nil
+}
+
+// videoMode returns the framebuffer passed to the kernel
+// for the video mode requested in the header.
+//
+// Without a VideoModeSetter the requested mode is passed through unchanged.
+// It fails if the requested mode is out of bounds.
+func (m *Multiboot) videoMode() (Framebuffer, error) {
+	req := m.header.requestedVideoMode()
+	if err := req.validate(); err != nil {
+		return Framebuffer{}, err
+	}
+	if m.videoModeSetter != nil {
+		return m.videoModeSetter.SetVideoMode(req)
+	}
+	fb := Framebuffer{
+		Width:  req.Width,
+		Height: req.Height,
+		BPP:    uint8(req.Depth),
+		Type:   FramebufferRGB,
+	}
+	if req.Type == ModeTypeText {
+		fb.Type = FramebufferText
+		fb.BPP = 16
+	}
+	return fb, nil
+}
+
+// setFramebuffer fills the framebuffer fields of info with fb.
+func (info *Info) setFramebuffer(fb Framebuffer) {
+	info.Flags |= flagInfoVideoInfo | flagInfoFrameBuffer
+	info.FramebufferAddr = fb.Addr
+	info.FramebufferPitch = fb.Pitch
+	info.FramebufferWidth = fb.Width
+	info.FramebufferHeight = fb.Height
+	info.FramebufferBPP = fb.BPP
+	info.FramebufferType = fb.Type
+}
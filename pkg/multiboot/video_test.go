@@ -0,0 +1,106 @@
+// Copyright 2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multiboot
+
+import (
+	"testing"
+)
+
+type fakeVideoModeSetter struct {
+	req VideoMode
+}
+
+func (s *fakeVideoModeSetter) SetVideoMode(req VideoMode) (Framebuffer, error) {
+	s.req = req
+	return Framebuffer{Addr: 0xfd000000, Pitch: 4096, Width: 1024, Height: 768, BPP: 32, Type: FramebufferRGB}, nil
+}
+
+func TestVideoMode(t *testing.T) {
+	hdr := Header{
+		mandatory: mandatory{Flags: flagHeaderMultibootVideoMode},
+		optional:  optional{ModeType: ModeTypeLinear, Width: 800, Height: 600, Depth: 24},
+	}
+
+	setter := &fakeVideoModeSetter{}
+	for _, test := range []struct {
+		name string
+		opts []Option
+		want Framebuffer
+	}{
+		{
+			name: "passthrough",
+			want: Framebuffer{Width: 800, Height: 600, BPP: 24, Type: FramebufferRGB},
+		},
+		{
+			name: "setter",
+			opts: []Option{WithVideoModeSetter(setter)},
+			want: Framebuffer{Addr: 0xfd000000, Pitch: 4096, Width: 1024, Height: 768, BPP: 32, Type: FramebufferRGB},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := New("", "", "", nil, test.opts...)
+			m.mem.Phys = testMemory
+			m.header = hdr
+			if _, err := m.addInfo(); err != nil {
+				t.Fatalf("addInfo() error: %v", err)
+			}
+			if want := flagInfoVideoInfo | flagInfoFrameBuffer; m.info.Flags&want != want {
+				t.Errorf("Flags got %#x, want video flags %#x", m.info.Flags, want)
+			}
+			got := Framebuffer{
+				Addr:   m.info.FramebufferAddr,
+				Pitch:  m.info.FramebufferPitch,
+				Width:  m.info.FramebufferWidth,
+				Height: m.info.FramebufferHeight,
+				BPP:    m.info.FramebufferBPP,
+				Type:   m.info.FramebufferType,
+			}
+			if got != test.want {
+				t.Errorf("framebuffer got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+	if want := hdr.requestedVideoMode(); setter.req != want {
+		t.Errorf("SetVideoMode() got request %+v, want %+v", setter.req, want)
+	}
+}
+
+func TestVideoModeOutOfRange(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		mode optional
+		ok   bool
+	}{
+		{name: "no preference", mode: optional{ModeType: ModeTypeLinear}, ok: true},
+		{name: "text", mode: optional{ModeType: ModeTypeText, Width: 80, Height: 25}, ok: true},
+		{name: "max", mode: optional{ModeType: ModeTypeLinear, Width: maxVideoWidth, Height: maxVideoHeight, Depth: maxVideoDepth}, ok: true},
+		{name: "type", mode: optional{ModeType: 2, Width: 800, Height: 600, Depth: 24}},
+		{name: "width", mode: optional{ModeType: ModeTypeLinear, Width: 0xffffffff, Height: 600, Depth: 24}},
+		{name: "height", mode: optional{ModeType: ModeTypeLinear, Width: 800, Height: maxVideoHeight + 1, Depth: 24}},
+		{name: "depth", mode: optional{ModeType: ModeTypeLinear, Width: 800, Height: 600, Depth: 999}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			setter := &fakeVideoModeSetter{}
+			m := New("", "", "", nil, WithVideoModeSetter(setter))
+			m.mem.Phys = testMemory
+			m.header = Header{
+				mandatory: mandatory{Flags: flagHeaderMultibootVideoMode},
+				optional:  test.mode,
+			}
+			_, err := m.addInfo()
+			if test.ok && err != nil {
+				t.Errorf("addInfo() got error %v, want nil", err)
+			}
+			if !test.ok {
+				if err == nil {
+					t.Errorf("addInfo() got nil error, want error")
+				}
+				if setter.req != (VideoMode{}) {
+					t.Errorf("SetVideoMode() called with %+v, want no call", setter.req)
+				}
+			}
+		})
+	}
+}
@@ -34,7 +34,6 @@ import (
 	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 
 	flag "github.com/spf13/pflag"
@@ -167,16 +166,7 @@ func main() {
 		}
 	}
 
-	p, err := os.Executable()
-	if err != nil {
-		log.Fatalf("Cannot find current executable path: %v", err)
-	}
-	trampoline, err := filepath.EvalSymlinks(p)
-	if err != nil {
-		log.Fatalf("Cannot eval symlinks for %v: %v", p, err)
-	}
-
-	m := multiboot.New(opts.kernel, opts.args, trampoline, opts.modules)
+	m := multiboot.New(opts.kernel, opts.args, "", opts.modules)
 	if err := m.Load(false); err != nil {
 		log.Fatalf("Load failed: %v", err)
 	}